@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// setACMEDefaults fills in the ACME settings not given in the config file, and checks the ones which were
+func setACMEDefaults(a *ACMEInfo, paths PathInfo, t TLSInfo) error {
+	if len(a.Domains) == 0 {
+		return nil
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		return errors.New("TLS certificates can either come from ACME or from the certfile and keyfile TLS settings, " +
+			"not both")
+	}
+	if a.CacheDir == "" {
+		a.CacheDir = filepath.Join(paths.BaseDir, "acme")
+	}
+	if a.DirectoryURL == "" {
+		a.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	return nil
+}
+
+// newACMEManager sets up the ACME certificate manager, which requests certificates for the configured domains when
+// they're first needed, and renews them before they expire.  The certificates and ACME account key are kept in the
+// cache directory, so they survive restarts.  Both the HTTP-01 and TLS-ALPN-01 challenges are supported, with HTTP-01
+// answered by the plain HTTP server (so it needs to be reachable on port 80)
+func newACMEManager(a ACMEInfo) (m *autocert.Manager, err error) {
+	err = os.MkdirAll(a.CacheDir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create the ACME cache directory: %w", err)
+	}
+	client := &acme.Client{DirectoryURL: a.DirectoryURL}
+
+	// A test ACME server (eg Pebble) generally uses a certificate from its own CA for its API
+	if a.CACert != "" {
+		pem, err := os.ReadFile(a.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read the ACME CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in the ACME CA certificate file '%s'", a.CACert)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+	m = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(a.CacheDir),
+		HostPolicy: autocert.HostWhitelist(a.Domains...),
+		Client:     client,
+		Email:      a.Email,
+	}
+	return
+}
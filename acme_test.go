@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+)
+
+// testACMEServer is a minimal stand-in for an ACME server such as Pebble.  It issues certificates from its own CA for a
+// single order at a time, really checking the challenge answers, but doesn't bother verifying the request signatures
+type testACMEServer struct {
+	*httptest.Server
+	chalType string // The only challenge type offered
+	httpAddr string // Where the HTTP-01 and TLS-ALPN-01 challenges are checked
+	tlsAddr  string
+	caCert   *x509.Certificate
+	caKey    *ecdsa.PrivateKey
+
+	mu         sync.Mutex
+	domain     string
+	authzValid bool
+	certPEM    []byte
+}
+
+func newTestACMEServer(t *testing.T, chalType string) *testACMEServer {
+	a := &testACMEServer{chalType: chalType}
+
+	// Create the CA the certificates are issued from
+	var err error
+	a.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &a.caKey.PublicKey, a.caKey)
+	require.NoError(t, err)
+	a.caCert, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dir", a.directory)
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {
+		a.nonce(w)
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", a.URL+"/account/1")
+		a.reply(w, http.StatusCreated, map[string]interface{}{"status": "valid"})
+	})
+	mux.HandleFunc("/order", a.newOrder)
+	mux.HandleFunc("/order/1", func(w http.ResponseWriter, r *http.Request) {
+		a.reply(w, http.StatusOK, a.order())
+	})
+	mux.HandleFunc("/authz/1", func(w http.ResponseWriter, r *http.Request) {
+		a.reply(w, http.StatusOK, a.authz())
+	})
+	mux.HandleFunc("/chal/1", a.challenge)
+	mux.HandleFunc("/finalize/1", a.finalize)
+	mux.HandleFunc("/cert/1", func(w http.ResponseWriter, r *http.Request) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.nonce(w)
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(a.certPEM)
+	})
+	a.Server = httptest.NewTLSServer(mux)
+	t.Cleanup(a.Close)
+	return a
+}
+
+func (a *testACMEServer) nonce(w http.ResponseWriter) {
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce%d", time.Now().UnixNano()))
+}
+
+func (a *testACMEServer) reply(w http.ResponseWriter, code int, v interface{}) {
+	a.nonce(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// payload returns the decoded payload of a JWS request
+func (a *testACMEServer) payload(r *http.Request, v interface{}) error {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return err
+	}
+	b, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (a *testACMEServer) directory(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"newNonce":   a.URL + "/nonce",
+		"newAccount": a.URL + "/account",
+		"newOrder":   a.URL + "/order",
+		"revokeCert": a.URL + "/revoke",
+		"keyChange":  a.URL + "/key-change",
+	})
+}
+
+func (a *testACMEServer) newOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Identifiers []struct{ Value string } `json:"identifiers"`
+	}
+	if err := a.payload(r, &req); err != nil || len(req.Identifiers) != 1 {
+		a.reply(w, http.StatusBadRequest, map[string]string{"type": "urn:ietf:params:acme:error:malformed"})
+		return
+	}
+	a.mu.Lock()
+	a.domain, a.authzValid, a.certPEM = req.Identifiers[0].Value, false, nil
+	a.mu.Unlock()
+	w.Header().Set("Location", a.URL+"/order/1")
+	a.reply(w, http.StatusCreated, a.order())
+}
+
+func (a *testACMEServer) order() map[string]interface{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	o := map[string]interface{}{
+		"status":         "pending",
+		"identifiers":    []map[string]string{{"type": "dns", "value": a.domain}},
+		"authorizations": []string{a.URL + "/authz/1"},
+		"finalize":       a.URL + "/finalize/1",
+	}
+	if a.authzValid {
+		o["status"] = "ready"
+	}
+	if a.certPEM != nil {
+		o["status"], o["certificate"] = "valid", a.URL+"/cert/1"
+	}
+	return o
+}
+
+func (a *testACMEServer) authz() map[string]interface{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	status := "pending"
+	if a.authzValid {
+		status = "valid"
+	}
+	return map[string]interface{}{
+		"status":     status,
+		"identifier": map[string]string{"type": "dns", "value": a.domain},
+		"challenges": []map[string]string{{"type": a.chalType, "url": a.URL + "/chal/1", "token": "token1",
+			"status": status}},
+	}
+}
+
+// challenge checks the answer to the challenge straight away
+func (a *testACMEServer) challenge(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	domain := a.domain
+	a.mu.Unlock()
+	var ok bool
+	switch a.chalType {
+	case "http-01":
+		req, _ := http.NewRequest("GET", "http://"+a.httpAddr+"/.well-known/acme-challenge/token1", nil)
+		req.Host = domain
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			ok = resp.StatusCode == http.StatusOK && strings.HasPrefix(string(body), "token1.")
+		}
+	case "tls-alpn-01":
+		conn, err := tls.Dial("tcp", a.tlsAddr, &tls.Config{
+			ServerName:         domain,
+			NextProtos:         []string{acme.ALPNProto},
+			InsecureSkipVerify: true,
+		})
+		if err == nil {
+			state := conn.ConnectionState()
+			conn.Close()
+			acmeIdentifier := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+			for _, ext := range state.PeerCertificates[0].Extensions {
+				ok = ok || ext.Id.Equal(acmeIdentifier)
+			}
+			ok = ok && state.NegotiatedProtocol == acme.ALPNProto
+		}
+	}
+	a.mu.Lock()
+	a.authzValid = ok
+	a.mu.Unlock()
+	status := "invalid"
+	if ok {
+		status = "valid"
+	}
+	a.reply(w, http.StatusOK, map[string]string{"type": a.chalType, "url": a.URL + "/chal/1", "token": "token1",
+		"status": status})
+}
+
+// finalize issues the certificate for the order
+func (a *testACMEServer) finalize(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	err := a.payload(r, &req)
+	var csr *x509.CertificateRequest
+	if err == nil {
+		var der []byte
+		der, err = base64.RawURLEncoding.DecodeString(req.CSR)
+		if err == nil {
+			csr, err = x509.ParseCertificateRequest(der)
+		}
+	}
+	var cert []byte
+	if err == nil {
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		cert, err = x509.CreateCertificate(rand.Reader, tmpl, a.caCert, csr.PublicKey, a.caKey)
+	}
+	if err != nil {
+		a.reply(w, http.StatusBadRequest, map[string]string{"type": "urn:ietf:params:acme:error:badCSR",
+			"detail": err.Error()})
+		return
+	}
+	a.mu.Lock()
+	a.certPEM = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.caCert.Raw})...)
+	a.mu.Unlock()
+	a.reply(w, http.StatusOK, a.order())
+}
+
+// freePort returns a local port which isn't in use
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// waitForListen waits until something is accepting connections on the given address
+func waitForListen(t *testing.T, addr string) {
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestACME(t *testing.T) {
+	for _, chalType := range []string{"http-01", "tls-alpn-01"} {
+		t.Run(chalType, func(t *testing.T) {
+			oldConf := Conf
+			t.Cleanup(func() { Conf = oldConf })
+
+			// Point the ACME settings at the test server, trusting its certificate
+			a := newTestACMEServer(t, chalType)
+			dir := t.TempDir()
+			caFile := filepath.Join(dir, "acme-ca.pem")
+			require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+				Bytes: a.Certificate().Raw}), 0644))
+			Conf.TLS = TLSInfo{}
+			Conf.ACME = ACMEInfo{Domains: []string{"downloads.example.test"}, CACert: caFile,
+				DirectoryURL: a.URL + "/dir", Email: "admin@example.test"}
+			Conf.Paths.BaseDir = dir
+			require.NoError(t, setACMEDefaults(&Conf.ACME, Conf.Paths, Conf.TLS))
+			assert.Equal(t, filepath.Join(dir, "acme"), Conf.ACME.CacheDir)
+			Conf.Server.Port, Conf.Server.SSLPort, Conf.Server.HTTP = freePort(t), freePort(t), "redirect"
+			a.httpAddr = fmt.Sprintf("127.0.0.1:%d", Conf.Server.Port)
+			a.tlsAddr = fmt.Sprintf("127.0.0.1:%d", Conf.Server.SSLPort)
+
+			router := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "hello")
+			})
+			servers, _, err := startServers(router)
+			require.NoError(t, err)
+			defer shutdownServers(time.Second, servers...)
+			waitForListen(t, a.httpAddr)
+			waitForListen(t, a.tlsAddr)
+
+			// The certificate is requested on the first connection, with the challenge answered by whichever server
+			// handles that type
+			roots := x509.NewCertPool()
+			roots.AddCert(a.caCert)
+			client := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, network, a.tlsAddr)
+				},
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			}}
+			defer client.CloseIdleConnections()
+			resp, err := client.Get(fmt.Sprintf("https://downloads.example.test:%d/", Conf.Server.SSLPort))
+			require.NoError(t, err)
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, "hello", string(body))
+			assert.Equal(t, "downloads.example.test", resp.TLS.PeerCertificates[0].Subject.CommonName)
+
+			// The certificate is cached on disk
+			_, err = os.Stat(filepath.Join(Conf.ACME.CacheDir, "downloads.example.test"))
+			assert.NoError(t, err)
+
+			// Other domains don't get certificates
+			_, err = tls.Dial("tcp", a.tlsAddr, &tls.Config{ServerName: "other.example.test", RootCAs: roots})
+			assert.Error(t, err)
+		})
+	}
+
+	// ACME can't be used along with certificate files
+	assert.Error(t, setACMEDefaults(&ACMEInfo{Domains: []string{"example.test"}}, PathInfo{},
+		TLSInfo{CertFile: "cert.pem", KeyFile: "key.pem"}))
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// aggregatePeriod describes one set of the daily/weekly/monthly stats tables
+type aggregatePeriod struct {
+	unit           string // PostgreSQL date_trunc() unit for the period
+	downloadsTable string
+	usersTable     string
+}
+
+// The stats tables filled in from download_log
+var aggregatePeriods = []aggregatePeriod{
+	{"day", "db4s_downloads_daily", "db4s_users_daily"},
+	{"week", "db4s_downloads_weekly", "db4s_users_weekly"},
+	{"month", "db4s_downloads_monthly", "db4s_users_monthly"},
+}
+
+// periodStart returns the start (in UTC) of the day, week (starting Monday, like PostgreSQL), or month containing t
+func periodStart(unit string, t time.Time) time.Time {
+	t = t.UTC()
+	switch unit {
+	case "week":
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// periodEnd returns the start (in UTC) of the day, week, or month after the one containing t
+func periodEnd(unit string, t time.Time) time.Time {
+	start := periodStart(unit, t)
+	switch unit {
+	case "week":
+		return start.AddDate(0, 0, 7)
+	case "month":
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// aggregateCommand fills in the stats tables from download_log.  With no options, only the periods containing
+// downloads added since the last run are updated.  Otherwise the given date range is (re)calculated
+func aggregateCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("aggregate", flag.ContinueOnError)
+	fromDate := flags.String("from", "", "First date (YYYY-MM-DD) to recalculate the stats for")
+	toDate := flags.String("to", "", "Last date (YYYY-MM-DD) to recalculate the stats for.  Defaults to today")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+	var from, to time.Time
+	if *fromDate != "" {
+		from, err = time.Parse(time.DateOnly, *fromDate)
+		if err != nil {
+			return fmt.Errorf("invalid -from date: %w", err)
+		}
+		to = time.Now()
+		if *toDate != "" {
+			to, err = time.Parse(time.DateOnly, *toDate)
+			if err != nil {
+				return fmt.Errorf("invalid -to date: %w", err)
+			}
+		}
+		if to.Before(from) {
+			return errors.New("the -to date is before the -from date")
+		}
+	} else if *toDate != "" {
+		return errors.New("a -from date is needed when giving a -to date")
+	}
+
+	// The release catalog is needed to know which downloads are which
+	err = readCatalog()
+	if err != nil {
+		return
+	}
+	err = connectPostgreSQL()
+	if err == nil {
+		defer DB.Close()
+		err = DB.Ping(context.Background())
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't connect to PostgreSQL: %w", err)
+	}
+
+	if from.IsZero() {
+		return aggregateNewDownloads(context.Background())
+	}
+	return aggregateDateRange(context.Background(), from, to)
+}
+
+// aggregator periodically updates the stats tables with the downloads recorded since the last run, then applies the
+// retention policy to the download_log entries which are no longer needed
+func aggregator() {
+	ticker := time.NewTicker(time.Duration(Conf.Stats.AggregateInterval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := aggregateNewDownloads(context.Background())
+		if err != nil {
+			log.Printf("Updating the download stats failed, will try again later: %v", err)
+			continue
+		}
+		err = applyRetention(context.Background(), Conf.Privacy)
+		if err != nil {
+			log.Printf("Applying the download_log retention policy failed, will try again later: %v", err)
+		}
+	}
+}
+
+// aggregateNewDownloads updates the stats for the periods containing downloads added to download_log since the last
+// run.  Whole periods are recalculated each time, so downloads added late (eg replayed from the journal) are included
+// as well.  The exception is periods the retention policy has already been applied to, as recalculating those from the
+// rows left would lose the removed ones.  Late downloads in those periods are added to the existing download counts
+// instead, while their users counts are left as they are, as there's no telling whether the addresses were already
+// counted
+func aggregateNewDownloads(ctx context.Context) (err error) {
+	return aggregateTx(ctx, func(tx pgx.Tx) (err error) {
+		// Find the downloads added since last time
+		var lastID int64
+		err = tx.QueryRow(ctx, `
+			SELECT last_download_id
+			FROM db4s_aggregate_state
+			WHERE name = 'download_log'`).Scan(&lastID)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return
+		}
+		retained, err := retainedUntil(ctx, tx)
+		if err != nil {
+			return
+		}
+		var (
+			first, last       *time.Time
+			maxID             *int64
+			newRows, lateRows int64
+		)
+		err = tx.QueryRow(ctx, `
+			SELECT min(request_time), max(request_time), max(download_id), count(*),
+				count(*) FILTER (WHERE request_time < $2)
+			FROM download_log
+			WHERE download_id > $1`, lastID, retained).Scan(&first, &last, &maxID, &newRows, &lateRows)
+		if err != nil || maxID == nil {
+			return
+		}
+
+		// Recalculate the periods they're in, then remember how far we've got
+		if first != nil {
+			err = aggregateRange(ctx, tx, *first, *last)
+			if err != nil {
+				return
+			}
+			if lateRows > 0 {
+				err = addLateDownloads(ctx, tx, lastID, *maxID, retained)
+				if err != nil {
+					return
+				}
+				log.Printf("%d new download_log entries are from before %s, which the retention policy has been "+
+					"applied to, so were only added to the download counts", lateRows,
+					retained.UTC().Format(time.DateOnly))
+			}
+			log.Printf("Download stats updated for %s to %s, covering %d new download_log entries",
+				first.UTC().Format(time.DateOnly), last.UTC().Format(time.DateOnly), newRows)
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO db4s_aggregate_state (name, last_download_id, aggregated_until)
+			VALUES ('download_log', $1, now())
+			ON CONFLICT (name) DO UPDATE
+				SET last_download_id = EXCLUDED.last_download_id, aggregated_until = EXCLUDED.aggregated_until`, *maxID)
+		return
+	})
+}
+
+// aggregateDateRange recalculates the stats for the periods containing the given dates, for backfilling
+func aggregateDateRange(ctx context.Context, from, to time.Time) (err error) {
+	err = aggregateTx(ctx, func(tx pgx.Tx) error {
+		return aggregateRange(ctx, tx, from, to)
+	})
+	if err == nil {
+		log.Printf("Download stats recalculated for %s to %s", from.UTC().Format(time.DateOnly),
+			to.UTC().Format(time.DateOnly))
+	}
+	return
+}
+
+// aggregateTx runs an aggregation task in a transaction, after bringing the download and release lists up to date.
+// Only one aggregation runs at a time, even with several servers sharing the database
+func aggregateTx(ctx context.Context, task func(tx pgx.Tx) error) (err error) {
+	return pgx.BeginFunc(ctx, DB, func(tx pgx.Tx) (err error) {
+		_, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('db4s_aggregate'))`)
+		if err != nil {
+			return
+		}
+		err = syncDownloadInfo(ctx, tx, catalog.Load())
+		if err != nil {
+			return
+		}
+		return task(tx)
+	})
+}
+
+// syncDownloadInfo adds the releases and assets in the release catalog to the db4s_release_info and
+// db4s_download_info tables, which the stats tables refer to.  Existing entries keep their friendly names
+func syncDownloadInfo(ctx context.Context, tx pgx.Tx, cat *ReleaseCatalog) (err error) {
+	var batch pgx.Batch
+	for _, r := range cat.Releases {
+		batch.Queue(`
+			INSERT INTO db4s_release_info (version_number, friendly_name)
+			VALUES ($1, $2)
+			ON CONFLICT (version_number) DO NOTHING`, r.Version, "DB4S "+r.Version)
+	}
+	addAsset := func(name, version string) {
+		batch.Queue(`
+			INSERT INTO db4s_download_info (file_name, friendly_name, db4s_release)
+			VALUES ($1, $1, (SELECT release_id FROM db4s_release_info WHERE version_number = $2))
+			ON CONFLICT (file_name) DO UPDATE
+				SET db4s_release = EXCLUDED.db4s_release`, name, version)
+	}
+	for _, a := range cat.Files {
+		addAsset(a.Name, "")
+	}
+	for _, r := range cat.Releases {
+		for _, a := range r.Assets {
+			addAsset(a.Name, r.Version)
+		}
+	}
+	return tx.SendBatch(ctx, &batch).Close()
+}
+
+// retainedUntil returns the time the retention policy had been applied up to when it last ran, or the zero time if it
+// hasn't run.  download_log rows from before then may have been removed or anonymised
+func retainedUntil(ctx context.Context, tx pgx.Tx) (until time.Time, err error) {
+	err = tx.QueryRow(ctx, `
+		SELECT aggregated_until
+		FROM db4s_aggregate_state
+		WHERE name = 'retention'`).Scan(&until)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return
+}
+
+// recalculateFrom returns the start of the first day, week, or month whose stats can still be recalculated from
+// download_log, given the time the retention policy has been applied up to.  The retention boundary always falls on the
+// start of a week, but not necessarily on the start of a month
+func recalculateFrom(unit string, retained time.Time) time.Time {
+	start := periodStart(unit, retained)
+	if start.Before(retained) {
+		return periodEnd(unit, retained)
+	}
+	return start
+}
+
+// addLateDownloads adds the downloads with IDs after lastID (up to maxID), in the periods the retention policy has
+// already been applied to, to the existing download counts for those periods
+func addLateDownloads(ctx context.Context, tx pgx.Tx, lastID, maxID int64, retained time.Time) (err error) {
+	for _, p := range aggregatePeriods {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO `+p.downloadsTable+` AS s (stats_date, db4s_download, num_downloads)
+			SELECT date_trunc('`+p.unit+`', l.request_time AT TIME ZONE 'UTC'), d.download_id, count(*)
+			FROM download_log l
+				JOIN db4s_download_info d ON d.file_name = ltrim(split_part(l.request, '?', 1), '/')
+			WHERE l.download_id > $1 AND l.download_id <= $2
+				AND l.request_time < $3
+				AND l.request_type = 'GET'
+				AND coalesce(l.completed, l.status = 200)
+				AND l.ua_class IS DISTINCT FROM 'bot'
+			GROUP BY 1, 2
+			ON CONFLICT (stats_date, db4s_download) DO UPDATE
+				SET num_downloads = s.num_downloads + EXCLUDED.num_downloads`,
+			lastID, maxID, recalculateFrom(p.unit, retained))
+		if err != nil {
+			return fmt.Errorf("adding late downloads to %s failed: %w", p.downloadsTable, err)
+		}
+	}
+	return
+}
+
+// aggregateRange recalculates the stats for every day, week, and month containing a time between first and last.
+// The existing unique indexes on the stats tables are used to replace the previous values, so running this more than
+// once for the same dates is harmless.  Periods the retention policy has already been applied to are skipped, as their
+// stats can't be recalculated from the rows left in download_log.
+//
+// Downloads are the completed GET requests for each asset, so a file fetched in pieces with range requests only counts
+// once, when the last piece arrives.  Rows recorded before completion was tracked count if they were successful.  Users
+// are the number of different IP addresses checking for updates from each DB4S release, going by the
+// "sqlitebrowser <version>" user agent DB4S sends.  Requests whose user agent was classified as a bot aren't counted
+func aggregateRange(ctx context.Context, tx pgx.Tx, first, last time.Time) (err error) {
+	retained, err := retainedUntil(ctx, tx)
+	if err != nil {
+		return
+	}
+	for _, p := range aggregatePeriods {
+		start, end := periodStart(p.unit, first), periodEnd(p.unit, last)
+		if from := recalculateFrom(p.unit, retained); start.Before(from) {
+			start = from
+		}
+		if !start.Before(end) {
+			continue
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO `+p.downloadsTable+` (stats_date, db4s_download, num_downloads)
+			SELECT date_trunc('`+p.unit+`', l.request_time AT TIME ZONE 'UTC'), d.download_id, count(*)
+			FROM download_log l
+				JOIN db4s_download_info d ON d.file_name = ltrim(split_part(l.request, '?', 1), '/')
+			WHERE l.request_time >= $1 AND l.request_time < $2
+				AND l.request_type = 'GET'
+				AND coalesce(l.completed, l.status = 200)
+				AND l.ua_class IS DISTINCT FROM 'bot'
+			GROUP BY 1, 2
+			ON CONFLICT (stats_date, db4s_download) DO UPDATE
+				SET num_downloads = EXCLUDED.num_downloads`, start, end)
+		if err != nil {
+			return fmt.Errorf("updating %s failed: %w", p.downloadsTable, err)
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO `+p.usersTable+` (stats_date, db4s_release, unique_ips)
+			SELECT date_trunc('`+p.unit+`', l.request_time AT TIME ZONE 'UTC'), r.release_id,
+				count(DISTINCT coalesce(l.client_ipv4, l.client_ipv6, l.client_ip_strange))
+			FROM download_log l
+				JOIN db4s_release_info r
+					ON r.version_number = substring(l.http_user_agent FROM '^sqlitebrowser ([0-9][0-9A-Za-z.-]*)')
+			WHERE l.request_time >= $1 AND l.request_time < $2
+				AND split_part(l.request, '?', 1) = '/currentrelease'
+				AND l.status = 200
+				AND l.ua_class IS DISTINCT FROM 'bot'
+			GROUP BY 1, 2
+			ON CONFLICT (stats_date, db4s_release) DO UPDATE
+				SET unique_ips = EXCLUDED.unique_ips`, start, end)
+		if err != nil {
+			return fmt.Errorf("updating %s failed: %w", p.usersTable, err)
+		}
+	}
+	return
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregatePeriods(t *testing.T) {
+	date := func(s string) time.Time {
+		d, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	tests := []struct {
+		unit       string
+		t          string
+		start, end string
+	}{
+		{"day", "2024-10-16T07:48:52Z", "2024-10-16T00:00:00Z", "2024-10-17T00:00:00Z"},
+		{"day", "2024-12-31T23:59:59Z", "2024-12-31T00:00:00Z", "2025-01-01T00:00:00Z"},
+		{"day", "2024-10-16T23:30:00-05:00", "2024-10-17T00:00:00Z", "2024-10-18T00:00:00Z"},
+		{"week", "2024-10-16T07:48:52Z", "2024-10-14T00:00:00Z", "2024-10-21T00:00:00Z"},
+		{"week", "2024-10-14T00:00:00Z", "2024-10-14T00:00:00Z", "2024-10-21T00:00:00Z"},
+		{"week", "2024-10-20T23:59:59Z", "2024-10-14T00:00:00Z", "2024-10-21T00:00:00Z"},
+		{"week", "2025-01-01T12:00:00Z", "2024-12-30T00:00:00Z", "2025-01-06T00:00:00Z"},
+		{"month", "2024-10-16T07:48:52Z", "2024-10-01T00:00:00Z", "2024-11-01T00:00:00Z"},
+		{"month", "2024-12-31T23:59:59Z", "2024-12-01T00:00:00Z", "2025-01-01T00:00:00Z"},
+		{"month", "2024-02-29T12:00:00Z", "2024-02-01T00:00:00Z", "2024-03-01T00:00:00Z"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.unit+" "+tc.t, func(t *testing.T) {
+			assert.Equal(t, date(tc.start), periodStart(tc.unit, date(tc.t)))
+			assert.Equal(t, date(tc.end), periodEnd(tc.unit, date(tc.t)))
+		})
+	}
+}
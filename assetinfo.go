@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// assetInfo describes a DB4S download, as worked out from its file name
+type assetInfo struct {
+	version  string // DB4S version number.  eg "3.13.1"
+	os       string // Operating system, using the same names as the release catalog.  eg "windows", "macos", "linux"
+	arch     string // CPU architecture, using the same names as the release catalog.  eg "x86", "x64", "universal"
+	pkg      string // Package type.  "msi", "exe", "zip", "dmg", "appimage", or "paf" (PortableApps.com)
+	portable bool   // Whether it runs without being installed
+}
+
+var (
+	// Matches the version number in an asset name.  It comes after a dash or underscore, and is sometimes prefixed
+	// with "v" or followed by a rebuild number.  eg "-v3.13.1-", "_3.12.2_", "-3.11.1v2."
+	assetVersionRegex = regexp.MustCompile(`(?:^|[-_])v?([0-9]+\.[0-9]+\.[0-9]+)(?:v[0-9]+)?(?:[-_.]|$)`)
+
+	// Matches the CPU architecture in an asset name, checked in this order
+	assetArchRegexes = []struct {
+		arch  string
+		regex *regexp.Regexp
+	}{
+		{"x64", regexp.MustCompile(`win64|x86[-_.]64|amd64`)},
+		{"x86", regexp.MustCompile(`win32|x86|i[36]86`)},
+		{"arm64", regexp.MustCompile(`arm64|aarch64`)},
+	}
+
+	// The package types, going by the end of the asset name.  Checked in this order, so ".paf.exe" is found before
+	// ".exe"
+	assetPackages = []struct {
+		suffix   string
+		pkg      string
+		os       string
+		portable bool
+	}{
+		{".paf.exe", "paf", "windows", true},
+		{".msi", "msi", "windows", false},
+		{".exe", "exe", "windows", false},
+		{".zip", "zip", "windows", true},
+		{".dmg", "dmg", "macos", false},
+		{".appimage", "appimage", "linux", true},
+	}
+)
+
+// parseAssetName works out the version, operating system, architecture, and package type of a DB4S download from its
+// file name.  This covers all of the naming schemes used over the years, eg:
+//
+//	DB.Browser.for.SQLite-v3.13.1-win64.msi
+//	DB.Browser.for.SQLite-arm64-3.12.2.dmg
+//	DB_Browser_for_SQLite-v3.12.2-x86_64.AppImage
+//	SQLiteDatabaseBrowserPortable_3.11.2_Rev_2_English.paf.exe
+//
+// ok is false if the name doesn't look like a DB4S download
+func parseAssetName(name string) (info assetInfo, ok bool) {
+	lower := strings.ToLower(name)
+	for _, p := range assetPackages {
+		if strings.HasSuffix(lower, p.suffix) {
+			info.pkg, info.os, info.portable, ok = p.pkg, p.os, p.portable, true
+			break
+		}
+	}
+	if !ok {
+		return
+	}
+	m := assetVersionRegex.FindStringSubmatch(name)
+	if m == nil {
+		return info, false
+	}
+	info.version = m[1]
+
+	// The architecture is only in the name when there's more than one to choose from
+	for _, a := range assetArchRegexes {
+		if a.regex.MatchString(lower) {
+			info.arch = a.arch
+			break
+		}
+	}
+	if info.arch == "" {
+		switch info.pkg {
+		case "paf":
+			// The PortableApps.com packages include both the 32 and 64-bit versions
+			info.arch = "universal"
+		case "dmg":
+			// The macOS builds were Intel only until 3.13.0, which was the first universal one
+			info.arch = "x64"
+			if compareVersions(info.version, "3.13.0") >= 0 {
+				info.arch = "universal"
+			}
+		}
+	}
+	return
+}
+
+// compareVersions compares two version numbers in "major.minor.patch" format, returning -1, 0, or 1
+func compareVersions(a, b string) int {
+	var x, y [3]int
+	fmt.Sscanf(a, "%d.%d.%d", &x[0], &x[1], &x[2])
+	fmt.Sscanf(b, "%d.%d.%d", &y[0], &y[1], &y[2])
+	for i := range x {
+		switch {
+		case x[i] < y[i]:
+			return -1
+		case x[i] > y[i]:
+			return 1
+		}
+	}
+	return 0
+}
+
+// setAsset fills in the asset details of a download record from the requested file name.  They're left empty for
+// requests which aren't DB4S downloads
+func (r *downloadRecord) setAsset() {
+	name, _, _ := strings.Cut(r.Request, "?")
+	info, ok := parseAssetName(path.Base(name))
+	if !ok {
+		r.AssetVersion, r.AssetOS, r.AssetArch, r.AssetPackage = pgtype.Text{}, pgtype.Text{}, pgtype.Text{}, pgtype.Text{}
+		r.AssetPortable = pgtype.Bool{}
+		return
+	}
+	text := func(s string) pgtype.Text {
+		return pgtype.Text{String: s, Valid: s != ""}
+	}
+	r.AssetVersion, r.AssetOS, r.AssetArch, r.AssetPackage = text(info.version), text(info.os), text(info.arch),
+		text(info.pkg)
+	r.AssetPortable = pgtype.Bool{Bool: info.portable, Valid: true}
+}
+
+// backfillAssetsCommand fills in the asset details of the PostgreSQL download_log rows recorded before they were added
+func backfillAssetsCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("backfill-assets", flag.ContinueOnError)
+	batchSize := flags.Int("batch", Conf.Logging.BatchSize, "Number of download_log rows to update at a time")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+	if *batchSize <= 0 {
+		return fmt.Errorf("the batch size needs to be at least 1")
+	}
+	err = connectPostgreSQL()
+	if err == nil {
+		defer DB.Close()
+		err = DB.Ping(context.Background())
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't connect to PostgreSQL: %w", err)
+	}
+	n, err := backfillAssets(context.Background(), *batchSize)
+	if err != nil {
+		return
+	}
+	fmt.Printf("Filled in the asset details of %d downloads\n", n)
+	return
+}
+
+// backfillAssets fills in the asset details of the download_log rows which don't have them, in batches.  Requests
+// which aren't DB4S downloads are left as they are
+func backfillAssets(ctx context.Context, batchSize int) (n int64, err error) {
+	var lastID int64
+	for {
+		type request struct {
+			id      int64
+			request string
+		}
+		var (
+			rows pgx.Rows
+			reqs []request
+		)
+		rows, err = DB.Query(ctx, `
+			SELECT download_id, coalesce(request, '')
+			FROM download_log
+			WHERE download_id > $1
+				AND asset_package IS NULL
+			ORDER BY download_id
+			LIMIT $2`, lastID, batchSize)
+		if err != nil {
+			return
+		}
+		reqs, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (r request, err error) {
+			err = row.Scan(&r.id, &r.request)
+			return
+		})
+		if err != nil || len(reqs) == 0 {
+			return
+		}
+
+		var batch pgx.Batch
+		for _, req := range reqs {
+			lastID = req.id
+			rec := downloadRecord{Request: req.request}
+			rec.setAsset()
+			if !rec.AssetPackage.Valid {
+				continue
+			}
+			batch.Queue(`
+				UPDATE download_log
+				SET asset_version = $2, asset_os = $3, asset_arch = $4, asset_package = $5, asset_portable = $6
+				WHERE download_id = $1`, req.id, rec.AssetVersion, rec.AssetOS, rec.AssetArch, rec.AssetPackage,
+				rec.AssetPortable)
+		}
+		if batch.Len() > 0 {
+			err = DB.SendBatch(ctx, &batch).Close()
+			if err != nil {
+				return
+			}
+			n += int64(batch.Len())
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAssetName(t *testing.T) {
+	tests := []struct {
+		name string
+		want assetInfo
+	}{
+		{"DB.Browser.for.SQLite-v3.13.1-win64.msi", assetInfo{"3.13.1", "windows", "x64", "msi", false}},
+		{"DB.Browser.for.SQLite-v3.13.1-win32.zip", assetInfo{"3.13.1", "windows", "x86", "zip", true}},
+		{"DB.Browser.for.SQLite-v3.13.1.dmg", assetInfo{"3.13.1", "macos", "universal", "dmg", false}},
+		{"DB.Browser.for.SQLite-v3.13.1-x86.64-v2.AppImage", assetInfo{"3.13.1", "linux", "x64", "appimage", true}},
+		{"DB_Browser_for_SQLite-v3.12.2-x86_64.AppImage", assetInfo{"3.12.2", "linux", "x64", "appimage", true}},
+		{"DB.Browser.for.SQLite-arm64-3.12.2.dmg", assetInfo{"3.12.2", "macos", "arm64", "dmg", false}},
+		{"DB.Browser.for.SQLite-3.12.2.dmg", assetInfo{"3.12.2", "macos", "x64", "dmg", false}},
+		{"DB.Browser.for.SQLite-3.11.1v2.dmg", assetInfo{"3.11.1", "macos", "x64", "dmg", false}},
+		{"DB.Browser.for.SQLite-3.10.1-win32.exe", assetInfo{"3.10.1", "windows", "x86", "exe", false}},
+		{"SQLiteDatabaseBrowserPortable_3.11.2_Rev_2_English.paf.exe", assetInfo{"3.11.2", "windows", "universal", "paf", true}},
+	}
+	for _, tt := range tests {
+		got, ok := parseAssetName(tt.name)
+		if assert.True(t, ok, tt.name) {
+			assert.Equal(t, tt.want, got, tt.name)
+		}
+	}
+
+	// Things which aren't DB4S downloads
+	for _, name := range []string{"", "currentrelease", "favicon.ico", "SHA256SUMS.txt", "setup.exe", "DB4S-3.13.1.tar.gz"} {
+		_, ok := parseAssetName(name)
+		assert.False(t, ok, name)
+	}
+}
+
+// Every asset in the release catalog should be understood, with the same operating system and architecture as the
+// catalog gives
+func TestParseAssetNameCatalog(t *testing.T) {
+	cat, err := loadCatalog("releases.toml", PathInfo{DataDir: t.TempDir()})
+	require.NoError(t, err)
+	for _, r := range cat.Releases {
+		for _, a := range r.Assets {
+			got, ok := parseAssetName(a.Name)
+			if assert.True(t, ok, a.Name) {
+				assert.Equal(t, r.Version, got.version, a.Name)
+				assert.Equal(t, a.OS, got.os, a.Name)
+				assert.Equal(t, a.Arch, got.arch, a.Name)
+			}
+		}
+	}
+}
+
+func TestSetAsset(t *testing.T) {
+	rec := downloadRecord{Request: "/DB.Browser.for.SQLite-v3.13.1-win64.msi?source=website"}
+	rec.setAsset()
+	assert.Equal(t, "3.13.1", rec.AssetVersion.String)
+	assert.Equal(t, "windows", rec.AssetOS.String)
+	assert.Equal(t, "x64", rec.AssetArch.String)
+	assert.Equal(t, "msi", rec.AssetPackage.String)
+	assert.True(t, rec.AssetPortable.Valid)
+	assert.False(t, rec.AssetPortable.Bool)
+
+	rec.Request = "/currentrelease"
+	rec.setAsset()
+	assert.False(t, rec.AssetVersion.Valid)
+	assert.False(t, rec.AssetPackage.Valid)
+	assert.False(t, rec.AssetPortable.Valid)
+}
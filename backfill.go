@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// backfillCommand fills in the details worked out when a download is recorded (the asset details and user agent
+// classification) for the PostgreSQL download_log rows recorded before they were added.  With -all, every row is
+// updated, eg after changing the user agent rules
+func backfillCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	batchSize := flags.Int("batch", Conf.Logging.BatchSize, "Number of download_log rows to update at a time")
+	all := flags.Bool("all", false, "Update every row, not just the ones missing the details")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+	if *batchSize <= 0 {
+		return errors.New("the batch size needs to be at least 1")
+	}
+	err = readUserAgentRules()
+	if err != nil {
+		return
+	}
+	err = connectPostgreSQL()
+	if err == nil {
+		defer DB.Close()
+		err = DB.Ping(context.Background())
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't connect to PostgreSQL: %w", err)
+	}
+	n, err := backfillDownloads(context.Background(), *batchSize, *all, userAgentRules.Load())
+	if err != nil {
+		return
+	}
+	fmt.Printf("Updated the details of %d downloads\n", n)
+	return
+}
+
+// backfillDownloads fills in the asset details and user agent classification of the download_log rows, in batches.
+// Unless all is set, only the rows which haven't had their user agent classified (or which are missing the asset
+// details) are updated
+func backfillDownloads(ctx context.Context, batchSize int, all bool, rules *UserAgentRules) (n int64, err error) {
+	var lastID int64
+	for {
+		type request struct {
+			id        int64
+			request   string
+			userAgent string
+		}
+		var (
+			rows pgx.Rows
+			reqs []request
+		)
+		rows, err = DB.Query(ctx, `
+			SELECT download_id, coalesce(request, ''), coalesce(http_user_agent, '')
+			FROM download_log
+			WHERE download_id > $1
+				AND ($3 OR asset_package IS NULL OR ua_class IS NULL)
+			ORDER BY download_id
+			LIMIT $2`, lastID, batchSize, all)
+		if err != nil {
+			return
+		}
+		reqs, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (r request, err error) {
+			err = row.Scan(&r.id, &r.request, &r.userAgent)
+			return
+		})
+		if err != nil || len(reqs) == 0 {
+			return
+		}
+
+		var batch pgx.Batch
+		for _, req := range reqs {
+			lastID = req.id
+			rec := downloadRecord{Request: req.request, HTTPUserAgent: req.userAgent}
+			rec.setAsset()
+			rec.setUserAgentClass(rules)
+			batch.Queue(`
+				UPDATE download_log
+				SET asset_version = $2, asset_os = $3, asset_arch = $4, asset_package = $5, asset_portable = $6,
+					ua_class = $7, ua_name = $8, ua_os = $9
+				WHERE download_id = $1`, req.id, rec.AssetVersion, rec.AssetOS, rec.AssetArch, rec.AssetPackage,
+				rec.AssetPortable, rec.UAClass, rec.UAName, rec.UAOS)
+		}
+		err = DB.SendBatch(ctx, &batch).Close()
+		if err != nil {
+			return
+		}
+		n += int64(batch.Len())
+	}
+}
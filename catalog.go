@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// catalogPath returns the location of the release catalog file
+func catalogPath(paths PathInfo) string {
+	if paths.Catalog != "" {
+		return paths.Catalog
+	}
+	return filepath.Join(paths.BaseDir, "releases.toml")
+}
+
+// loadCatalog reads a release catalog file, and builds the lookup index for the assets in it
+func loadCatalog(fileName string, paths PathInfo) (cat *ReleaseCatalog, err error) {
+	cat = &ReleaseCatalog{paths: paths}
+	if _, err = toml.DecodeFile(fileName, cat); err != nil {
+		return nil, err
+	}
+
+	// Build the lookup index, rejecting any entries which don't make sense
+	cat.assets = make(map[string]CatalogAsset)
+	add := func(a CatalogAsset) error {
+		if a.Name == "" {
+			return fmt.Errorf("release catalog '%s' has an asset without a name", fileName)
+		}
+		if a.Name != filepath.Base(a.Name) {
+			return fmt.Errorf("release catalog '%s' has an asset with a path in its name: '%s'", fileName, a.Name)
+		}
+		if _, ok := cat.assets[a.Name]; ok {
+			return fmt.Errorf("release catalog '%s' lists asset '%s' more than once", fileName, a.Name)
+		}
+		cat.assets[a.Name] = a
+		return nil
+	}
+	for _, a := range cat.Files {
+		if err = add(a); err != nil {
+			return nil, err
+		}
+	}
+	for i, r := range cat.Releases {
+		if r.Version == "" {
+			return nil, fmt.Errorf("release catalog '%s' has a release without a version number", fileName)
+		}
+		if r.Channel == "" {
+			cat.Releases[i].Channel = "stable"
+		}
+		if r.Notes == "" {
+			cat.Releases[i].Notes = fmt.Sprintf("https://github.com/sqlitebrowser/sqlitebrowser/releases/tag/v%s", r.Version)
+		}
+		for _, a := range r.Assets {
+			if err = add(a); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return
+}
+
+// readCatalog loads the release catalog specified in the configuration
+func readCatalog() (err error) {
+	fileName := catalogPath(Conf.Paths)
+	cat, err := loadCatalog(fileName, Conf.Paths)
+	if err != nil {
+		return
+	}
+	catalog.Store(cat)
+	if debug.Load() {
+		log.Printf("Release catalog '%s' loaded, %d assets available for download", fileName, len(cat.assets))
+	}
+	return
+}
+
+// Asset looks up a downloadable file in the catalog by name
+func (cat *ReleaseCatalog) Asset(name string) (a CatalogAsset, ok bool) {
+	a, ok = cat.assets[name]
+	return
+}
+
+// AllAssets returns every asset in the catalog, in catalog order
+func (cat *ReleaseCatalog) AllAssets() (assets []CatalogAsset) {
+	assets = append(assets, cat.Files...)
+	for _, r := range cat.Releases {
+		assets = append(assets, r.Assets...)
+	}
+	return
+}
+
+// AssetNames returns the names of the assets in the given release, for the given operating system.  Either can be left
+// empty to match any release or operating system
+func (cat *ReleaseCatalog) AssetNames(version, osName string) (names []string) {
+	osName = normaliseOS(osName)
+	match := func(a CatalogAsset) {
+		if osName == "" || a.OS == osName {
+			names = append(names, a.Name)
+		}
+	}
+	if version == "" {
+		for _, a := range cat.Files {
+			match(a)
+		}
+	}
+	for _, r := range cat.Releases {
+		if version != "" && r.Version != version {
+			continue
+		}
+		for _, a := range r.Assets {
+			match(a)
+		}
+	}
+	return
+}
+
+// CurrentRelease returns the newest release in the given channel.  If an operating system is given, only releases
+// with an asset for that operating system (and architecture, if given) are considered, and the first such asset is
+// returned as well
+func (cat *ReleaseCatalog) CurrentRelease(channel, osName, arch string) (rel CatalogRelease, asset CatalogAsset, ok bool) {
+	channel = strings.ToLower(channel)
+	if channel == "" {
+		channel = "stable"
+	}
+	osName = normaliseOS(osName)
+	arch = normaliseArch(arch)
+	for _, r := range cat.Releases {
+		if r.Channel != channel {
+			continue
+		}
+		if osName == "" {
+			return r, CatalogAsset{}, true
+		}
+		for _, a := range r.Assets {
+			if a.Hidden || a.OS != osName {
+				continue
+			}
+			if arch == "" || a.Arch == arch || a.Arch == "universal" {
+				return r, a, true
+			}
+		}
+	}
+	return
+}
+
+// normaliseOS converts the various names used for operating systems into the ones used in the release catalog
+func normaliseOS(s string) string {
+	s = strings.ToLower(s)
+	switch s {
+	case "win", "win32", "win64":
+		return "windows"
+	case "mac", "macosx", "osx", "darwin":
+		return "macos"
+	}
+	return s
+}
+
+// normaliseArch converts the various names used for CPU architectures into the ones used in the release catalog
+func normaliseArch(s string) string {
+	s = strings.ToLower(s)
+	switch s {
+	case "i386", "i686", "386", "x86_32", "32":
+		return "x86"
+	case "amd64", "x86_64", "x86-64", "64":
+		return "x64"
+	case "aarch64":
+		return "arm64"
+	}
+	return s
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The TLS certificate loaded from the certfile and keyfile settings.  Swapped out atomically when the files change, so
+// renewed certificates are picked up without a restart, with connections already open carrying on with the old one
+var tlsCert atomic.Pointer[tls.Certificate]
+
+// certFilesState holds the details used to tell when the certificate or key file has changed on disk
+type certFilesState struct {
+	cert, key fileState
+}
+
+// loadCertificate loads the TLS certificate and private key, checking they belong together and that the certificate is
+// currently valid
+func loadCertificate(certFile, keyFile string) (cert *tls.Certificate, err error) {
+	c, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return
+	}
+	c.Leaf, err = x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	if now.Before(c.Leaf.NotBefore) {
+		return nil, fmt.Errorf("certificate isn't valid until %s", c.Leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(c.Leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate expired at %s", c.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return &c, nil
+}
+
+// getCertificate returns the current TLS certificate, for tls.Config.GetCertificate
+func getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return tlsCert.Load(), nil
+}
+
+// reloadCertificate loads the TLS certificate and key again, then swaps them in.  If the new ones can't be loaded (eg
+// the files are only part way through being renewed), the existing certificate is kept
+func reloadCertificate(certFile, keyFile string) (err error) {
+	cert, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		log.Printf("Reloading the TLS certificate '%s' failed, keeping the existing one: %s", certFile, err)
+		return
+	}
+	tlsCert.Store(cert)
+	log.Printf("TLS certificate '%s' reloaded, valid until %s", certFile, cert.Leaf.NotAfter.Format(time.RFC3339))
+	return
+}
+
+// watchCertificate reloads the TLS certificate when SIGHUP is received, or when the certificate or key file changes on
+// disk (eg when certbot renews them).  The files are checked every reload_interval seconds, the same as the
+// configuration file
+func watchCertificate(certFile, keyFile string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// Only poll for file changes if a check interval has been set
+	var tick <-chan time.Time
+	if Conf.Server.ReloadInterval > 0 {
+		t := time.NewTicker(time.Duration(Conf.Server.ReloadInterval) * time.Second)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	watched := certFiles(certFile, keyFile)
+	for {
+		select {
+		case <-hup:
+		case <-tick:
+			if certFiles(certFile, keyFile) == watched {
+				continue
+			}
+		}
+
+		// The state is recorded before loading, so a broken pair isn't tried again until one of the files changes
+		watched = certFiles(certFile, keyFile)
+		_ = reloadCertificate(certFile, keyFile)
+	}
+}
+
+// certFiles returns the current state of the certificate and key files
+func certFiles(certFile, keyFile string) (s certFilesState) {
+	// Missing files are left with a zero state, so they're detected when they turn up again
+	if info, err := os.Stat(certFile); err == nil {
+		s.cert = fileState{modTime: info.ModTime(), size: info.Size()}
+	}
+	if info, err := os.Stat(keyFile); err == nil {
+		s.key = fileState{modTime: info.ModTime(), size: info.Size()}
+	}
+	return
+}
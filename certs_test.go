@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCertificate writes a self signed certificate and its key to the given files, returning the certificate's
+// serial number
+func writeTestCertificate(t *testing.T, certFile, keyFile string, notBefore, notAfter time.Time) *big.Int {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial := big.NewInt(time.Now().UnixNano())
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "download.sqlitebrowser.org"},
+		DNSNames:     []string{"download.sqlitebrowser.org"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	return serial
+}
+
+func TestCertificateReload(t *testing.T) {
+	t.Cleanup(func() { tlsCert.Store(nil) })
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+	first := writeTestCertificate(t, certFile, keyFile, now.Add(-time.Hour), now.Add(24*time.Hour))
+	cert, err := loadCertificate(certFile, keyFile)
+	require.NoError(t, err)
+	tlsCert.Store(cert)
+
+	// Serve the certificate, the same as the HTTPS server does
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverTLSConfig(nil))
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	served := func() *big.Int {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		require.NoError(t, err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber
+	}
+	assert.Equal(t, first, served())
+
+	// The watched state only changes when the files do
+	watched := certFiles(certFile, keyFile)
+	assert.Equal(t, watched, certFiles(certFile, keyFile))
+
+	// A certificate and key which don't belong together aren't swapped in.  This is what's seen part way through a
+	// renewal, when only one of the files has been written so far
+	keep, err := os.ReadFile(keyFile)
+	require.NoError(t, err)
+	second := writeTestCertificate(t, certFile, keyFile, now.Add(-time.Hour), now.Add(48*time.Hour))
+	newKey, err := os.ReadFile(keyFile)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyFile, keep, 0600))
+	assert.NotEqual(t, watched, certFiles(certFile, keyFile))
+	assert.Error(t, reloadCertificate(certFile, keyFile))
+	assert.Equal(t, first, served())
+
+	// Once the renewal is complete, the new certificate is served
+	require.NoError(t, os.WriteFile(keyFile, newKey, 0600))
+	require.NoError(t, reloadCertificate(certFile, keyFile))
+	assert.Equal(t, second, served())
+
+	// Expired certificates, and missing files, aren't swapped in either
+	writeTestCertificate(t, certFile, keyFile, now.Add(-48*time.Hour), now.Add(-time.Hour))
+	assert.ErrorContains(t, reloadCertificate(certFile, keyFile), "expired")
+	require.NoError(t, os.Remove(certFile))
+	assert.Error(t, reloadCertificate(certFile, keyFile))
+	assert.Equal(t, second, served())
+	assert.Zero(t, certFiles(certFile, keyFile).cert)
+
+	// The expiry of the certificate being served is in the metrics
+	w := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	expiry := float64(tlsCert.Load().Leaf.NotAfter.Unix())
+	assert.Contains(t, w.Body.String(),
+		"db4s_tls_certificate_expiry_timestamp_seconds "+strconv.FormatFloat(expiry, 'g', -1, 64)+"\n")
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/singleflight"
+)
+
+// assetChecksum holds the SHA256 checksum of a file, along with the file details it was calculated for.  If the size or
+// modification time of the file changes, the checksum needs to be calculated again
+type assetChecksum struct {
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+}
+
+var (
+	// Checksums of the files in the data directory, keyed by their full path
+	checksums   = make(map[string]assetChecksum)
+	checksumsMu sync.Mutex
+
+	// Checksum calculations in progress, so each changed file is only read once however many requests want it
+	checksumCalcs singleflight.Group
+
+	// Returned when the checksum of a file on disk doesn't match the one in the release catalog
+	errChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// loadChecksumCache reads the previously calculated checksums from the cache file, if one is configured
+func loadChecksumCache(fileName string) {
+	if fileName == "" {
+		return
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Couldn't read checksum cache file '%s': %s", fileName, err)
+		}
+		return
+	}
+	cache := make(map[string]assetChecksum)
+	err = json.Unmarshal(data, &cache)
+	if err != nil {
+		log.Printf("Ignoring damaged checksum cache file '%s': %s", fileName, err)
+		return
+	}
+	checksumsMu.Lock()
+	checksums = cache
+	checksumsMu.Unlock()
+}
+
+// saveChecksumCache writes the calculated checksums to the cache file, if one is configured
+func saveChecksumCache(fileName string) {
+	if fileName == "" {
+		return
+	}
+	checksumsMu.Lock()
+	data, err := json.MarshalIndent(checksums, "", "  ")
+	checksumsMu.Unlock()
+	if err != nil {
+		log.Printf("Couldn't encode checksum cache: %s", err)
+		return
+	}
+
+	// Write to a temporary file first, so a crash part way through doesn't leave a damaged cache behind
+	tmpFile := fileName + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0644)
+	if err == nil {
+		err = os.Rename(tmpFile, fileName)
+	}
+	if err != nil {
+		log.Printf("Couldn't write checksum cache file '%s': %s", fileName, err)
+	}
+}
+
+// fileChecksum returns the SHA256 checksum of a file, only reading the file if its size or modification time has
+// changed since the checksum was last calculated.  When a file has changed, only the first request for it reads it
+// again, with any others arriving in the meantime waiting for that result rather than reading the file themselves
+func fileChecksum(fullPath string, info os.FileInfo) (sum string, err error) {
+	sum, cached, current := cachedChecksum(fullPath, info)
+	if current {
+		return
+	}
+	key := fmt.Sprintf("%s:%d:%d", fullPath, info.Size(), info.ModTime().UnixNano())
+	v, err, _ := checksumCalcs.Do(key, func() (interface{}, error) {
+		// A request which checked the cache just before the previous calculation finished ends up here too late to
+		// share it, so the cache is checked again
+		if sum, _, current := cachedChecksum(fullPath, info); current {
+			return sum, nil
+		}
+		if cached {
+			log.Printf("File '%s' has changed on disk, calculating its checksum again", fullPath)
+		}
+		return calcChecksum(fullPath, info)
+	})
+	if err != nil {
+		return
+	}
+	return v.(string), nil
+}
+
+// cachedChecksum looks up the cached checksum of a file.  It's only current if the file's size and modification time
+// are the same as when the checksum was calculated
+func cachedChecksum(fullPath string, info os.FileInfo) (sum string, cached, current bool) {
+	checksumsMu.Lock()
+	c, cached := checksums[fullPath]
+	checksumsMu.Unlock()
+	return c.SHA256, cached, cached && c.Size == info.Size() && c.ModTime.Equal(info.ModTime())
+}
+
+// calcChecksum reads a file to calculate its SHA256 checksum, then caches it
+func calcChecksum(fullPath string, info os.FileInfo) (sum string, err error) {
+	checksumCalculations.Inc()
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return
+	}
+	sum = hex.EncodeToString(h.Sum(nil))
+
+	checksumsMu.Lock()
+	checksums[fullPath] = assetChecksum{ModTime: info.ModTime(), SHA256: sum, Size: info.Size()}
+	checksumsMu.Unlock()
+	return
+}
+
+// verifyAsset returns the checksum of an asset on disk, checking it against the one in the release catalog (if given)
+func verifyAsset(cat *ReleaseCatalog, asset CatalogAsset, info os.FileInfo) (sum string, err error) {
+	sum, err = fileChecksum(filepath.Join(cat.paths.DataDir, asset.Name), info)
+	if err != nil {
+		return
+	}
+	if asset.SHA256 != "" && !strings.EqualFold(asset.SHA256, sum) {
+		return sum, errChecksumMismatch
+	}
+	return
+}
+
+// hashAssets calculates the checksums of all the assets in a release catalog, so they're ready before the catalog is
+// used.  Assets which are missing, or whose checksum doesn't match the one in the catalog, are logged
+func hashAssets(cat *ReleaseCatalog) {
+	start := time.Now()
+	for _, a := range cat.AllAssets() {
+		info, err := os.Stat(filepath.Join(cat.paths.DataDir, a.Name))
+		if err != nil {
+			log.Printf("Asset '%s' from the release catalog isn't available: %s", a.Name, err)
+			continue
+		}
+		_, err = verifyAsset(cat, a, info)
+		if errors.Is(err, errChecksumMismatch) {
+			log.Printf("Checksum of asset '%s' doesn't match the release catalog, it won't be served", a.Name)
+		} else if err != nil {
+			log.Printf("Couldn't calculate the checksum of asset '%s': %s", a.Name, err)
+		}
+	}
+	saveChecksumCache(cat.paths.ChecksumCache)
+	if debug.Load() {
+		log.Printf("Checksums of the release catalog assets verified in %s", time.Since(start))
+	}
+}
+
+// checksumLine returns the checksum of an asset on disk in sha256sum format, or an error if it's unavailable or
+// doesn't match the release catalog
+func checksumLine(cat *ReleaseCatalog, asset CatalogAsset) (line string, err error) {
+	info, err := os.Stat(filepath.Join(cat.paths.DataDir, asset.Name))
+	if err != nil {
+		return
+	}
+	sum, err := verifyAsset(cat, asset, info)
+	if err != nil {
+		return
+	}
+	return fmt.Sprintf("%s  %s\n", sum, asset.Name), nil
+}
+
+// checksumsHandler serves the SHA256SUMS.txt file, generated from the assets in the release catalog
+func checksumsHandler(c *gin.Context, cat *ReleaseCatalog) {
+	assets := cat.AllAssets()
+	slices.SortFunc(assets, func(a, b CatalogAsset) int { return strings.Compare(a.Name, b.Name) })
+	var (
+		sums   strings.Builder
+		latest time.Time
+	)
+	for _, a := range assets {
+		line, err := checksumLine(cat, a)
+		if err != nil {
+			// Problems are logged when the asset itself is requested, so we just leave it out here
+			continue
+		}
+		sums.WriteString(line)
+		if a.Timestamp.After(latest) {
+			latest = a.Timestamp
+		}
+	}
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(c.Writer, c.Request, "SHA256SUMS.txt", latest, strings.NewReader(sums.String()))
+}
+
+// assetChecksumHandler serves the "<asset name>.sha256" checksum file for a single asset
+func assetChecksumHandler(c *gin.Context, cat *ReleaseCatalog, asset CatalogAsset) {
+	line, err := checksumLine(cat, asset)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		fmt.Fprintf(c.Writer, "Internal server error")
+		log.Printf("Error occured when trying to retrieve the checksum of '%s': %s", asset.Name, err)
+		return
+	}
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(c.Writer, c.Request, asset.Name+".sha256", asset.Timestamp, strings.NewReader(line))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksums(t *testing.T) {
+	oldCat := catalog.Load()
+	t.Cleanup(func() {
+		catalog.Store(oldCat)
+	})
+
+	// Create a data directory with two assets.  The catalog checksum for "good.msi" is correct, but the one for
+	// "bad.dmg" isn't
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "good.msi"), []byte("good"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bad.dmg"), []byte("bad"), 0644))
+	catFile := filepath.Join(dir, "releases.toml")
+	cat := `[[release]]
+version = "1.0.0"
+
+  [[release.asset]]
+  name = "good.msi"
+  timestamp = 2024-10-16T07:48:52Z
+  sha256 = "770e607624d689265ca6c44884d0807d9b054d23c473c106c72be9de08b7376c"
+
+  [[release.asset]]
+  name = "bad.dmg"
+  timestamp = 2024-10-16T07:48:52Z
+  sha256 = "0000000000000000000000000000000000000000000000000000000000000000"
+`
+	require.NoError(t, os.WriteFile(catFile, []byte(cat), 0644))
+	// Hash the assets, using a cache file
+	cacheFile := filepath.Join(dir, "checksums.json")
+	c, err := loadCatalog(catFile, PathInfo{DataDir: dir, ChecksumCache: cacheFile})
+	require.NoError(t, err)
+	catalog.Store(c)
+	hashAssets(c)
+	assert.FileExists(t, cacheFile)
+
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.GET("/:filename", fileHandler)
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Only the asset with a matching checksum should be listed and served
+	w := get("/SHA256SUMS.txt")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "770e607624d689265ca6c44884d0807d9b054d23c473c106c72be9de08b7376c  good.msi\n", w.Body.String())
+
+	w = get("/good.msi.sha256")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "770e607624d689265ca6c44884d0807d9b054d23c473c106c72be9de08b7376c  good.msi\n", w.Body.String())
+
+	w = get("/good.msi")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "good", w.Body.String())
+
+	w = get("/bad.dmg")
+	assert.Equal(t, 500, w.Code)
+	w = get("/bad.dmg.sha256")
+	assert.Equal(t, 500, w.Code)
+
+	// Changing a file on disk after startup must be noticed
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "good.msi"), []byte("changed"), 0644))
+	w = get("/good.msi")
+	assert.Equal(t, 500, w.Code)
+
+	// A changed file is only read once, however many requests for it arrive while its checksum is being calculated.
+	// The requests all start together, so most arrive while the first one is still reading the file, and any arriving
+	// too late to share its result find it in the cache
+	fullPath := filepath.Join(dir, "good.msi")
+	require.NoError(t, os.WriteFile(fullPath, bytes.Repeat([]byte("large"), 2<<20), 0644))
+	info, err := os.Stat(fullPath)
+	require.NoError(t, err)
+	before := testutil.ToFloat64(checksumCalculations)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	sums := make([]string, 8)
+	for i := range sums {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			sums[i], _ = fileChecksum(fullPath, info)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	assert.Equal(t, before+1, testutil.ToFloat64(checksumCalculations))
+	for _, sum := range sums {
+		assert.Len(t, sum, 64)
+		assert.Equal(t, sums[0], sum)
+	}
+}
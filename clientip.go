@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// parseTrustedProxies converts the trusted proxy list from the config file into address prefixes.  Entries can be
+// either CIDR ranges (eg "10.0.0.0/8"), or single IP addresses
+func parseTrustedProxies(list []string) (prefixes []netip.Prefix, err error) {
+	for _, s := range list {
+		var p netip.Prefix
+		if strings.Contains(s, "/") {
+			p, err = netip.ParsePrefix(s)
+		} else {
+			var a netip.Addr
+			a, err = netip.ParseAddr(s)
+			p = netip.PrefixFrom(a, a.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': %w", s, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return
+}
+
+// isTrustedProxy returns true if the address is in one of the trusted proxy ranges
+func isTrustedProxy(addr netip.Addr, trusted []netip.Prefix) bool {
+	addr = addr.Unmap()
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHeaders returns the proxy forwarding headers of a request as received, one "Name: value" line per header,
+// for recording alongside the download.  It's not valid if the request has none
+func forwardedHeaders(r *http.Request) pgtype.Text {
+	var lines []string
+	for _, name := range []string{"Forwarded", "X-Forwarded-For"} {
+		for _, v := range r.Header.Values(name) {
+			lines = append(lines, name+": "+v)
+		}
+	}
+	if len(lines) == 0 {
+		return pgtype.Text{Valid: false}
+	}
+	return pgtype.Text{String: strings.Join(lines, "\n"), Valid: true}
+}
+
+// resolveClientAddress works out the address of the client making a request.  If the request came directly from a
+// trusted proxy, the forwarding headers it added are followed from right to left (ie the most recently added first),
+// skipping any other trusted proxies, until the first untrusted address is reached.  That's the client.
+//
+// Only the header our proxies write the client address to is read ("x-forwarded-for" or "forwarded", as set by the
+// forwarded_header setting).  Proxies pass other forwarding headers through as the client sent them, so believing
+// those would let clients choose the address that's recorded.
+//
+// The address is returned as "ip", "ip:port" or "[ipv6]:port", the same as Go's RemoteAddr.  When a forwarding header
+// contains something which isn't an IP address (eg "unknown"), that's returned as is
+func resolveClientAddress(r *http.Request, trusted []netip.Prefix, header string) string {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil || !isTrustedProxy(peer.Addr(), trusted) {
+		// Not from a trusted proxy, so the forwarding headers (if any) can't be believed
+		return r.RemoteAddr
+	}
+
+	// Get the list of hops the request passed through, oldest first
+	var hops []string
+	if strings.EqualFold(header, "forwarded") {
+		hops = parseForwarded(strings.Join(r.Header.Values("Forwarded"), ","))
+	} else if v := r.Header.Values("X-Forwarded-For"); len(v) > 0 {
+		for _, h := range strings.Split(strings.Join(v, ","), ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				hops = append(hops, h)
+			}
+		}
+	}
+
+	// Walk back through the hops until one isn't a trusted proxy
+	client := r.RemoteAddr
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ip, ok := parseHop(hops[i])
+		client = addr
+		if !ok || !isTrustedProxy(ip, trusted) {
+			break
+		}
+	}
+	return client
+}
+
+// parseForwarded returns the "for" values from an RFC 7239 Forwarded header, in the order they appear
+func parseForwarded(header string) (hops []string) {
+	for _, element := range splitQuoted(header, ',') {
+		for _, pair := range splitQuoted(element, ';') {
+			key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if !found || !strings.EqualFold(strings.TrimSpace(key), "for") {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+				value = strings.ReplaceAll(value[1:len(value)-1], `\"`, `"`)
+			}
+			hops = append(hops, value)
+		}
+	}
+	return
+}
+
+// splitQuoted splits a string on the separator, ignoring separators inside quoted strings
+func splitQuoted(s string, sep rune) (parts []string) {
+	inQuotes, escaped, start := false, false, 0
+	for i, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && inQuotes:
+			escaped = true
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == sep && !inQuotes:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseHop converts a single forwarding header entry to the same format as Go's RemoteAddr.  IPv4 addresses mapped
+// into IPv6 are converted back to plain IPv4.  Returns false, with the entry unchanged, if it isn't an IP address
+func parseHop(hop string) (addr string, ip netip.Addr, ok bool) {
+	if ap, err := netip.ParseAddrPort(hop); err == nil {
+		ip = ap.Addr().Unmap()
+		return netip.AddrPortFrom(ip, ap.Port()).String(), ip, true
+	}
+	// RFC 7239 puts brackets around IPv6 addresses even without a port number
+	if ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")); err == nil && ip.Zone() == "" {
+		ip = ip.Unmap()
+		return ip.String(), ip, true
+	}
+	return hop, ip, false
+}
+
+// parseClientAddress splits a client address (as returned by resolveClientAddress) into the database fields for it,
+// along with what kind of address it turned out to be.  IP addresses are stored in their standard text form, with IPv4
+// addresses mapped into IPv6 converted back to plain IPv4, and IPv6 zones removed.  Anything which isn't a single IP
+// address is stored in full in the "strange" field, for later investigation
+func parseClientAddress(s string) (entry dbEntry, class AddressClass) {
+	if s == "" {
+		return entry, ADDRESS_EMPTY
+	}
+	strange := func(c AddressClass) (dbEntry, AddressClass) {
+		entry.ipstrange = pgtype.Text{String: s, Valid: true}
+		return entry, c
+	}
+	if strings.ContainsAny(s, ", \t") {
+		// eg "1.2.3.4, 5.6.7.8", which some proxies send
+		return strange(ADDRESS_MULTIPLE)
+	}
+
+	// Split off the port number, if there is one.  IPv6 addresses with a port number need to be in brackets, so a
+	// bare IPv6 address is never mistaken for one with a port number
+	host, port, hasPort := s, "", false
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		host, port, hasPort = h, p, p != ""
+	} else if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		host = s[1 : len(s)-1]
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return strange(ADDRESS_INVALID)
+	}
+
+	// Record the IP address
+	switch {
+	case ip.Is4():
+		entry.ipv4 = pgtype.Text{String: ip.String(), Valid: true}
+		class = ADDRESS_IPV4
+		if hasPort {
+			class = ADDRESS_IPV4_PORT
+		}
+	case ip.Is4In6():
+		entry.ipv4 = pgtype.Text{String: ip.Unmap().String(), Valid: true}
+		class = ADDRESS_IPV4_MAPPED
+	default:
+		class = ADDRESS_IPV6
+		if ip.Zone() != "" {
+			// Zones only mean something to the local host, so aren't worth keeping
+			ip = ip.WithZone("")
+			class = ADDRESS_IPV6_ZONE
+		} else if hasPort {
+			class = ADDRESS_IPV6_PORT
+		}
+		entry.ipv6 = pgtype.Text{String: ip.String(), Valid: true}
+	}
+
+	// Record the port number, if it's valid
+	if hasPort {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || strconv.FormatUint(p, 10) != port {
+			return entry, ADDRESS_BAD_PORT
+		}
+		entry.port = pgtype.Int4{Int32: int32(p), Valid: true}
+	}
+	return
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveClientAddress(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "2001:db8:ffff::/48", "192.0.2.1"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		headers    map[string][]string
+		expected   string
+	}{
+		{"direct", "198.51.100.7:51234", "", nil, "198.51.100.7:51234"},
+		{"direct ipv6", "[2001:db8::7]:51234", "", nil, "[2001:db8::7]:51234"},
+		{"untrusted peer forging xff", "198.51.100.7:51234", "x-forwarded-for",
+			map[string][]string{"X-Forwarded-For": {"203.0.113.9"}}, "198.51.100.7:51234"},
+		{"trusted peer", "10.1.2.3:40000", "x-forwarded-for", map[string][]string{"X-Forwarded-For": {"203.0.113.9"}},
+			"203.0.113.9"},
+		{"trusted peer, no header", "10.1.2.3:40000", "x-forwarded-for", nil, "10.1.2.3:40000"},
+		{"chain with forged entry", "10.1.2.3:40000", "x-forwarded-for",
+			map[string][]string{"X-Forwarded-For": {"1.1.1.1, 203.0.113.9, 10.9.9.9"}}, "203.0.113.9"},
+		{"chain over multiple headers", "10.1.2.3:40000", "x-forwarded-for",
+			map[string][]string{"X-Forwarded-For": {"1.1.1.1", "203.0.113.9", "192.0.2.1"}}, "203.0.113.9"},
+		{"all trusted", "10.1.2.3:40000", "x-forwarded-for",
+			map[string][]string{"X-Forwarded-For": {"10.0.0.1, 10.0.0.2"}}, "10.0.0.1"},
+		{"xff ipv6", "[2001:db8:ffff::1]:443", "x-forwarded-for",
+			map[string][]string{"X-Forwarded-For": {"2001:db8::5"}}, "2001:db8::5"},
+		{"xff mapped ipv4", "10.1.2.3:40000", "x-forwarded-for",
+			map[string][]string{"X-Forwarded-For": {"::ffff:203.0.113.9"}}, "203.0.113.9"},
+		{"xff garbage", "10.1.2.3:40000", "x-forwarded-for",
+			map[string][]string{"X-Forwarded-For": {"1.1.1.1, unknown"}}, "unknown"},
+		{"forged forwarded ignored", "10.1.2.3:40000", "x-forwarded-for",
+			map[string][]string{"Forwarded": {"for=1.2.3.4"}, "X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"forged forwarded without xff", "10.1.2.3:40000", "x-forwarded-for",
+			map[string][]string{"Forwarded": {"for=1.2.3.4"}}, "10.1.2.3:40000"},
+		{"forwarded", "10.1.2.3:40000", "forwarded", map[string][]string{"Forwarded": {"for=203.0.113.9;proto=https"}},
+			"203.0.113.9"},
+		{"forwarded ipv6 with port", "10.1.2.3:40000", "forwarded",
+			map[string][]string{"Forwarded": {`for=1.1.1.1, For="[2001:db8:cafe::17]:4711";by=10.0.0.1`}},
+			"[2001:db8:cafe::17]:4711"},
+		{"forwarded ipv6 without port", "10.1.2.3:40000", "forwarded",
+			map[string][]string{"Forwarded": {`for="[2001:db8::17]"`}}, "2001:db8::17"},
+		{"forged xff ignored", "10.1.2.3:40000", "forwarded",
+			map[string][]string{"Forwarded": {"for=203.0.113.9"}, "X-Forwarded-For": {"1.2.3.4"}}, "203.0.113.9"},
+		{"forwarded obfuscated", "10.1.2.3:40000", "forwarded",
+			map[string][]string{"Forwarded": {"for=_hidden, for=10.0.0.5"}}, "_hidden"},
+		{"forwarded quoted separators", "10.1.2.3:40000", "forwarded",
+			map[string][]string{"Forwarded": {`for=203.0.113.9;ext="a,b;c", for=10.0.0.5`}}, "203.0.113.9"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for k, v := range tc.headers {
+				req.Header[k] = v
+			}
+			assert.Equal(t, tc.expected, resolveClientAddress(req, trusted, tc.header))
+		})
+	}
+
+	// The original headers are kept as received
+	req, _ := http.NewRequest("GET", "/", nil)
+	assert.False(t, forwardedHeaders(req).Valid)
+	req.Header.Add("X-Forwarded-For", "1.1.1.1, 203.0.113.9")
+	req.Header.Add("Forwarded", "for=203.0.113.9")
+	assert.Equal(t, "Forwarded: for=203.0.113.9\nX-Forwarded-For: 1.1.1.1, 203.0.113.9", forwardedHeaders(req).String)
+
+	_, err = parseTrustedProxies([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+	_, err = parseTrustedProxies([]string{"localhost"})
+	assert.Error(t, err)
+}
+
+func TestParseClientAddress(t *testing.T) {
+	text := func(s string) pgtype.Text { return pgtype.Text{String: s, Valid: true} }
+	port := func(p int32) pgtype.Int4 { return pgtype.Int4{Int32: p, Valid: true} }
+	tests := []struct {
+		addr     string
+		expected dbEntry
+		class    AddressClass
+	}{
+		{"", dbEntry{}, ADDRESS_EMPTY},
+		{"192.0.2.1", dbEntry{ipv4: text("192.0.2.1")}, ADDRESS_IPV4},
+		{"192.0.2.1:56789", dbEntry{ipv4: text("192.0.2.1"), port: port(56789)}, ADDRESS_IPV4_PORT},
+		{"192.0.2.1:0", dbEntry{ipv4: text("192.0.2.1"), port: port(0)}, ADDRESS_IPV4_PORT},
+		{"192.0.2.1:", dbEntry{ipv4: text("192.0.2.1")}, ADDRESS_IPV4},
+		{"192.0.2.1:65536", dbEntry{ipv4: text("192.0.2.1")}, ADDRESS_BAD_PORT},
+		{"192.0.2.1:080", dbEntry{ipv4: text("192.0.2.1")}, ADDRESS_BAD_PORT},
+		{"192.0.2.1:http", dbEntry{ipv4: text("192.0.2.1")}, ADDRESS_BAD_PORT},
+		{"192.0.2.001", dbEntry{ipstrange: text("192.0.2.001")}, ADDRESS_INVALID},
+		{"2001:db8::1", dbEntry{ipv6: text("2001:db8::1")}, ADDRESS_IPV6},
+		{"2001:DB8:0::1", dbEntry{ipv6: text("2001:db8::1")}, ADDRESS_IPV6},
+		{"[2001:db8::1]", dbEntry{ipv6: text("2001:db8::1")}, ADDRESS_IPV6},
+		{"[2001:db8::1]:443", dbEntry{ipv6: text("2001:db8::1"), port: port(443)}, ADDRESS_IPV6_PORT},
+		{"[2001:db8::1]:-1", dbEntry{ipv6: text("2001:db8::1")}, ADDRESS_BAD_PORT},
+		{"[2001:db8::1", dbEntry{ipstrange: text("[2001:db8::1")}, ADDRESS_INVALID},
+		{"fe80::1%eth0", dbEntry{ipv6: text("fe80::1")}, ADDRESS_IPV6_ZONE},
+		{"[fe80::1%25eth0]:8080", dbEntry{ipv6: text("fe80::1"), port: port(8080)}, ADDRESS_IPV6_ZONE},
+		{"::ffff:192.0.2.1", dbEntry{ipv4: text("192.0.2.1")}, ADDRESS_IPV4_MAPPED},
+		{"[::ffff:192.0.2.1]:1234", dbEntry{ipv4: text("192.0.2.1"), port: port(1234)}, ADDRESS_IPV4_MAPPED},
+		{"unknown", dbEntry{ipstrange: text("unknown")}, ADDRESS_INVALID},
+		{"unknown:1234", dbEntry{ipstrange: text("unknown:1234")}, ADDRESS_INVALID},
+		{"192.0.2.1, 198.51.100.2", dbEntry{ipstrange: text("192.0.2.1, 198.51.100.2")}, ADDRESS_MULTIPLE},
+		{"192.0.2.1,2001:db8::1", dbEntry{ipstrange: text("192.0.2.1,2001:db8::1")}, ADDRESS_MULTIPLE},
+	}
+	for _, tc := range tests {
+		t.Run(tc.addr, func(t *testing.T) {
+			entry, class := parseClientAddress(tc.addr)
+			assert.Equal(t, tc.expected, entry)
+			assert.Equal(t, tc.class, class)
+		})
+	}
+}
+
+func FuzzParseClientAddress(f *testing.F) {
+	for _, s := range []string{"", "192.0.2.1", "192.0.2.1:80", "2001:db8::1", "[2001:db8::1]:443", "fe80::1%eth0",
+		"::ffff:192.0.2.1", "unknown", "192.0.2.1, 198.51.100.2", "[::1]:99999"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		entry, class := parseClientAddress(s)
+
+		// Apart from an empty string, exactly one of the address fields is filled in
+		n := 0
+		for _, f := range []pgtype.Text{entry.ipv4, entry.ipv6, entry.ipstrange} {
+			if f.Valid {
+				n++
+			}
+		}
+		if s == "" {
+			if n != 0 || entry.port.Valid || class != ADDRESS_EMPTY {
+				t.Fatalf("empty address gave %+v, %s", entry, class)
+			}
+			return
+		}
+		if n != 1 {
+			t.Fatalf("%q filled in %d address fields", s, n)
+		}
+
+		// Strange addresses are kept exactly as given, without a port number
+		if entry.ipstrange.Valid {
+			if entry.ipstrange.String != s || entry.port.Valid {
+				t.Fatalf("%q gave strange entry %+v", s, entry)
+			}
+			if class != ADDRESS_INVALID && class != ADDRESS_MULTIPLE {
+				t.Fatalf("%q gave strange entry with class %s", s, class)
+			}
+			return
+		}
+
+		// Anything else is a valid address, in its standard form
+		if entry.ipv4.Valid {
+			ip, err := netip.ParseAddr(entry.ipv4.String)
+			if err != nil || !ip.Is4() || ip.String() != entry.ipv4.String {
+				t.Fatalf("%q gave bad ipv4 address %q", s, entry.ipv4.String)
+			}
+		}
+		if entry.ipv6.Valid {
+			ip, err := netip.ParseAddr(entry.ipv6.String)
+			if err != nil || !ip.Is6() || ip.Is4In6() || ip.Zone() != "" || ip.String() != entry.ipv6.String {
+				t.Fatalf("%q gave bad ipv6 address %q", s, entry.ipv6.String)
+			}
+		}
+		if entry.port.Valid && (entry.port.Int32 < 0 || entry.port.Int32 > 65535) {
+			t.Fatalf("%q gave port %d", s, entry.port.Int32)
+		}
+		if entry.port.Valid && class != ADDRESS_IPV4_PORT && class != ADDRESS_IPV6_PORT &&
+			class != ADDRESS_IPV4_MAPPED && class != ADDRESS_IPV6_ZONE {
+			t.Fatalf("%q gave a port number with class %s", s, class)
+		}
+		if entry.port.Valid && !strings.HasSuffix(s, ":"+strconv.Itoa(int(entry.port.Int32))) {
+			t.Fatalf("%q gave port %d", s, entry.port.Int32)
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// command is a maintenance task which can be run instead of the download server, by giving its name on the command
+// line.  eg "db4s_cluster_downloader import-sqlite -dry-run"
+type command struct {
+	name        string
+	description string
+	run         func(args []string) error
+}
+
+// The available maintenance commands
+var commands = []command{
+	{"aggregate", "Update the daily, weekly, and monthly download stats tables", aggregateCommand},
+	{"backfill", "Fill in the asset details and user agent classes of downloads recorded before they were added", backfillCommand},
+	{"backfill-assets", "Fill in the asset details of downloads recorded before they were added", backfillAssetsCommand},
+	{"collect-github", "Record the current download counts of the GitHub release assets", githubCommand},
+	{"export", "Export the download log as CSV, NDJSON, or Parquet", exportCommand},
+	{"import-sqlite", "Import the downloads recorded in the local SQLite database into PostgreSQL", importSQLiteCommand},
+	{"retention", "Delete or anonymise the download_log entries older than the retention period", retentionCommand},
+}
+
+// runCommand runs the named maintenance command, passing it the remaining command line arguments
+func runCommand(name string, args []string) (err error) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			err = cmd.run(args)
+			if errors.Is(err, flag.ErrHelp) {
+				// The options were asked for with -h, which isn't an error
+				err = nil
+			}
+			return
+		}
+	}
+
+	// Unknown command, so display the ones we do know about
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [options]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "With no command given, the download server is started.  Available commands:\n\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", cmd.name, cmd.description)
+	}
+	fmt.Fprintf(os.Stderr, "\nUse \"%s <command> -h\" for the options of a command\n", os.Args[0])
+	return fmt.Errorf("unknown command '%s'", name)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Key used to pass the download progress from fileHandler to logRequest
+const downloadProgressKey = "db4s_download_progress"
+
+// downloadProgress records how much of a file was sent in response to a request
+type downloadProgress struct {
+	total int64 // Size of the whole file
+	start int64 // First and last byte positions of a range request, as given in the Content-Range header.  Both are
+	end   int64 // -1 for full responses, and for requests asking for more than one range
+	sent  int64 // Number of bytes of the file sent, before any compression
+}
+
+// countingWriter passes writes through to a response writer, counting the bytes written
+type countingWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (w countingWriter) Write(b []byte) (n int, err error) {
+	n, err = w.ResponseWriter.Write(b)
+	*w.n += int64(n)
+	return
+}
+
+// Unwrap returns the underlying response writer, for http.ResponseController
+func (w countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// serveFile sends a file with http.ServeContent, recording how much of it was sent for logRequest to use
+func serveFile(c *gin.Context, name string, modTime time.Time, total int64, content io.ReadSeeker) {
+	p := &downloadProgress{total: total, start: -1, end: -1}
+	c.Set(downloadProgressKey, p)
+	activeDownloads.Inc()
+	activeTransfers.Add(1)
+	defer func() {
+		activeDownloads.Dec()
+		activeTransfers.Add(-1)
+	}()
+	http.ServeContent(countingWriter{ResponseWriter: transferWriter(c), n: &p.sent}, c.Request, name, modTime, content)
+	assetBytesSent.WithLabelValues(name).Add(float64(p.sent))
+	if c.Writer.Status() == http.StatusPartialContent {
+		var start, end, size int64
+		_, err := fmt.Sscanf(c.Writer.Header().Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size)
+		if err == nil && size == total {
+			p.start, p.end = start, end
+		}
+	}
+}
+
+// rangeCoalescer joins up consecutive range requests for the same file by the same client into a single logical
+// download.  Download managers and resuming browsers fetch large files in pieces, so only the request which completes
+// the file counts as a download.  Downloads with no new pieces for the coalescing window are forgotten
+type rangeCoalescer struct {
+	mu        sync.Mutex
+	window    time.Duration
+	downloads map[string]*rangedDownload
+	lastSweep time.Time
+}
+
+// rangedDownload is a logical download being put together from range requests
+type rangedDownload struct {
+	group    string     // Event ID of the first request, shared by all of the requests in the download
+	covered  [][2]int64 // Byte ranges of the file sent so far, sorted and merged, with exclusive ends
+	lastSeen time.Time
+}
+
+// Number of files currently being sent, for the shutdown to report on
+var activeTransfers atomic.Int64
+
+// The range coalescer used by logRequest.  It's replaced when the download logger starts, using the configured window
+var rangeDownloads = newRangeCoalescer(time.Hour)
+
+func newRangeCoalescer(window time.Duration) *rangeCoalescer {
+	return &rangeCoalescer{window: window, downloads: make(map[string]*rangedDownload)}
+}
+
+// add records the bytes sent by a range request.  It returns the download group the request belongs to (its own
+// event ID if it starts a new one), and whether this request completed the file
+func (rc *rangeCoalescer) add(key, eventID string, total, start, end int64, now time.Time) (group string, completed bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	// Forget about downloads which haven't been continued
+	if now.Sub(rc.lastSweep) > rc.window {
+		for k, d := range rc.downloads {
+			if now.Sub(d.lastSeen) > rc.window {
+				delete(rc.downloads, k)
+			}
+		}
+		rc.lastSweep = now
+	}
+
+	d, ok := rc.downloads[key]
+	if !ok || now.Sub(d.lastSeen) > rc.window {
+		d = &rangedDownload{group: eventID}
+		rc.downloads[key] = d
+	}
+	d.lastSeen = now
+	if end > start {
+		d.covered = mergeRange(d.covered, [2]int64{start, end})
+	}
+
+	// Once the whole file has been sent the download is done, and any further requests start a new one
+	if len(d.covered) == 1 && d.covered[0] == [2]int64{0, total} {
+		delete(rc.downloads, key)
+		return d.group, true
+	}
+	return d.group, false
+}
+
+// mergeRange adds a byte range to a sorted list of non-overlapping ones, joining up any which overlap or touch
+func mergeRange(ranges [][2]int64, r [2]int64) [][2]int64 {
+	i, _ := slices.BinarySearchFunc(ranges, r, func(a, b [2]int64) int {
+		return cmp.Compare(a[0], b[0])
+	})
+	ranges = slices.Insert(ranges, i, r)
+	merged := ranges[:1]
+	for _, x := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if x[0] <= last[1] {
+			last[1] = max(last[1], x[1])
+		} else {
+			merged = append(merged, x)
+		}
+	}
+	return merged
+}
+
+// setCompletion fills in how much of the file a download record's request was sent, and whether that makes it a
+// completed download.  Full responses are complete when the whole file was sent.  Range requests are coalesced with the
+// others for the same file from the same client, with the one which completes the file being the completed download.
+// HEAD requests, conditional requests answered with "304 Not Modified", and multiple range requests are never
+// complete.  key identifies the client, and must be worked out before the client address is anonymised
+func (r *downloadRecord) setCompletion(p *downloadProgress, key string) {
+	int8 := func(v int64) pgtype.Int8 {
+		return pgtype.Int8{Int64: v, Valid: v >= 0}
+	}
+	r.FileSize, r.FileBytesSent = int8(p.total), int8(p.sent)
+	r.DownloadGroup = r.EventID
+	completed := false
+	switch {
+	case r.RequestType != http.MethodGet:
+	case r.Status == http.StatusOK:
+		completed = p.sent == p.total
+	case r.Status == http.StatusPartialContent && p.start >= 0:
+		r.RangeStart, r.RangeEnd = int8(p.start), int8(p.end)
+
+		// Only the part of the range which was actually sent counts, in case the transfer was cut short
+		key += "\x00" + r.Request + "\x00" + strconv.FormatInt(p.total, 10)
+		group, done := rangeDownloads.add(key, r.EventID.String, p.total, p.start, p.start+p.sent, r.RequestTime)
+		r.DownloadGroup, completed = pgtype.Text{String: group, Valid: true}, done
+	}
+	r.Completed = pgtype.Bool{Bool: completed, Valid: true}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeRange(t *testing.T) {
+	var r [][2]int64
+	r = mergeRange(r, [2]int64{100, 200})
+	r = mergeRange(r, [2]int64{300, 400})
+	assert.Equal(t, [][2]int64{{100, 200}, {300, 400}}, r)
+	r = mergeRange(r, [2]int64{0, 50})
+	assert.Equal(t, [][2]int64{{0, 50}, {100, 200}, {300, 400}}, r)
+	r = mergeRange(r, [2]int64{50, 100})
+	assert.Equal(t, [][2]int64{{0, 200}, {300, 400}}, r)
+	r = mergeRange(r, [2]int64{150, 350})
+	assert.Equal(t, [][2]int64{{0, 400}}, r)
+}
+
+func TestSetCompletion(t *testing.T) {
+	rangeDownloads = newRangeCoalescer(time.Hour)
+	const content = "0123456789abcdefghijklmnopqrstuvwxyz"
+	when := time.Date(2024, 10, 14, 10, 0, 0, 0, time.UTC)
+
+	// Requests the test file with the given method and headers, returning the download record logRequest would make
+	n := 0
+	request := func(method, client string, at time.Time, headers ...string) downloadRecord {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(method, "/test.dmg", nil)
+		for i := 0; i < len(headers); i += 2 {
+			c.Request.Header.Set(headers[i], headers[i+1])
+		}
+		serveFile(c, "test.dmg", when, int64(len(content)), strings.NewReader(content))
+		n++
+		rec := downloadRecord{
+			RequestTime: at,
+			RequestType: method,
+			Request:     "/test.dmg",
+			Status:      c.Writer.Status(),
+			EventID:     pgtype.Text{String: strings.Repeat("e", n), Valid: true},
+		}
+		p, ok := c.Get(downloadProgressKey)
+		assert.True(t, ok)
+		rec.setCompletion(p.(*downloadProgress), client)
+		return rec
+	}
+
+	// A full download
+	r := request(http.MethodGet, "192.0.2.1", when)
+	assert.Equal(t, http.StatusOK, r.Status)
+	assert.True(t, r.Completed.Bool)
+	assert.Equal(t, int64(len(content)), r.FileBytesSent.Int64)
+	assert.Equal(t, int64(len(content)), r.FileSize.Int64)
+	assert.False(t, r.RangeStart.Valid)
+	assert.Equal(t, r.EventID, r.DownloadGroup)
+
+	// HEAD requests and conditional requests answered with 304 aren't downloads
+	r = request(http.MethodHead, "192.0.2.1", when)
+	assert.True(t, r.Completed.Valid)
+	assert.False(t, r.Completed.Bool)
+	r = request(http.MethodGet, "192.0.2.1", when, "If-Modified-Since", when.Format(http.TimeFormat))
+	assert.Equal(t, http.StatusNotModified, r.Status)
+	assert.False(t, r.Completed.Bool)
+	assert.Zero(t, r.FileBytesSent.Int64)
+
+	// Range requests are coalesced, with the one completing the file counted as the download
+	first := request(http.MethodGet, "192.0.2.1", when, "Range", "bytes=0-9")
+	assert.Equal(t, http.StatusPartialContent, first.Status)
+	assert.False(t, first.Completed.Bool)
+	assert.Equal(t, int64(0), first.RangeStart.Int64)
+	assert.Equal(t, int64(9), first.RangeEnd.Int64)
+	assert.Equal(t, int64(10), first.FileBytesSent.Int64)
+
+	// A different client's requests are separate
+	other := request(http.MethodGet, "192.0.2.2", when, "Range", "bytes=10-")
+	assert.False(t, other.Completed.Bool)
+	assert.NotEqual(t, first.DownloadGroup, other.DownloadGroup)
+
+	r = request(http.MethodGet, "192.0.2.1", when.Add(time.Minute), "Range", "bytes=20-")
+	assert.False(t, r.Completed.Bool)
+	assert.Equal(t, first.DownloadGroup, r.DownloadGroup)
+	r = request(http.MethodGet, "192.0.2.1", when.Add(2*time.Minute), "Range", "bytes=5-24")
+	assert.True(t, r.Completed.Bool)
+	assert.Equal(t, first.DownloadGroup, r.DownloadGroup)
+	assert.Equal(t, int64(5), r.RangeStart.Int64)
+	assert.Equal(t, int64(24), r.RangeEnd.Int64)
+
+	// Once complete, further range requests start a new download
+	r = request(http.MethodGet, "192.0.2.1", when.Add(3*time.Minute), "Range", "bytes=0-")
+	assert.True(t, r.Completed.Bool)
+	assert.Equal(t, r.EventID, r.DownloadGroup)
+
+	// Pieces too far apart aren't joined up
+	first = request(http.MethodGet, "192.0.2.1", when, "Range", "bytes=0-19")
+	r = request(http.MethodGet, "192.0.2.1", when.Add(2*time.Hour), "Range", "bytes=20-")
+	assert.False(t, r.Completed.Bool)
+	assert.NotEqual(t, first.DownloadGroup, r.DownloadGroup)
+
+	// Requests for several ranges at once aren't tracked
+	r = request(http.MethodGet, "192.0.2.3", when, "Range", "bytes=0-9,10-")
+	assert.Equal(t, http.StatusPartialContent, r.Status)
+	assert.False(t, r.Completed.Bool)
+	assert.False(t, r.RangeStart.Valid)
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// The stats dashboard template and static files, built into the executable so nothing needs fetching from elsewhere
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+var dashboardTemplate = template.Must(template.ParseFS(dashboardFiles, "dashboard/stats.html"))
+
+// dashboardRow is a line in the per release or per platform download tables
+type dashboardRow struct {
+	Name      string
+	Downloads int64
+	GitHub    int64
+}
+
+// dashboardData holds everything shown on the stats dashboard
+type dashboardData struct {
+	From, To       string
+	Granularity    string
+	GitHub         bool // Show the GitHub download counts as well
+	Error          string
+	Total          int64
+	DownloadsChart template.HTML
+	UsersChart     template.HTML
+	Releases       []dashboardRow
+	ReleasesChart  template.HTML
+	Platforms      []dashboardRow
+	PlatformsChart template.HTML
+	GitHubNote     string
+}
+
+// addDashboardRoutes adds the stats dashboard page, and its static files, to the router
+func addDashboardRoutes(router *gin.Engine) {
+	static, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	stats := router.Group("/stats", tokenAuth("Basic"))
+	stats.GET("", dashboardHandler)
+	stats.StaticFS("/static", http.FS(static))
+}
+
+// dashboardHandler shows the stats dashboard, using the same query parameters as the stats API
+func dashboardHandler(c *gin.Context) {
+	data := dashboardData{Granularity: c.DefaultQuery("granularity", "day"), GitHub: c.Query("github") != ""}
+	q, err := parseStatsQuery(c)
+	if err != nil {
+		data.Error = err.Error()
+		c.Render(http.StatusBadRequest, render.HTML{Template: dashboardTemplate, Name: "stats", Data: data})
+		return
+	}
+	data.From, data.To = q.from.Format(time.DateOnly), q.to.AddDate(0, 0, -1).Format(time.DateOnly)
+
+	err = fillDashboard(c.Request.Context(), q, &data)
+	status := http.StatusOK
+	if err != nil {
+		status = http.StatusInternalServerError
+		data.Error = "Retrieving the stats failed"
+		if errors.Is(err, errNoStatsDatabase) {
+			status, data.Error = http.StatusServiceUnavailable, err.Error()
+		} else {
+			log.Printf("Error when retrieving stats for the dashboard: %v", err)
+		}
+	}
+	c.Render(status, render.HTML{Template: dashboardTemplate, Name: "stats", Data: data})
+}
+
+// fillDashboard retrieves the stats for the dashboard, and draws the charts
+func fillDashboard(ctx context.Context, q statsQuery, data *dashboardData) (err error) {
+	downloads, err := downloadStats(ctx, q)
+	if err != nil {
+		return
+	}
+	users, err := userStats(ctx, q)
+	if err != nil {
+		return
+	}
+	data.DownloadsChart = svgColumnChart(downloads)
+	data.UsersChart = svgColumnChart(users)
+	for _, p := range downloads {
+		data.Total += p.Count
+	}
+
+	// Break the downloads down by release and platform, going by the release catalog
+	perFile, err := downloadsPerFile(ctx, q)
+	if err != nil {
+		return
+	}
+	var github map[string]int64
+	if data.GitHub {
+		github, data.GitHubNote, err = githubDownloadsPerFile(ctx, q)
+		if err != nil {
+			return
+		}
+	}
+	data.Releases, data.Platforms = groupDownloads(catalog.Load(), perFile, github)
+	data.ReleasesChart = svgBarChart(data.Releases, data.GitHub)
+	data.PlatformsChart = svgBarChart(data.Platforms, data.GitHub)
+	return
+}
+
+// downloadsPerFile returns the total number of downloads of each file over the time period
+func downloadsPerFile(ctx context.Context, q statsQuery) (counts map[string]int64, err error) {
+	counts = make(map[string]int64)
+	switch RecordDownloadsLocation {
+	case RECORD_IN_PG:
+		rows, err := DB.Query(ctx, `
+			SELECT d.file_name, sum(s.num_downloads)
+			FROM db4s_downloads_daily s
+				JOIN db4s_download_info d ON d.download_id = s.db4s_download
+			WHERE s.stats_date >= $1 AND s.stats_date < $2
+				AND d.file_name IS NOT NULL
+			GROUP BY 1`, q.from, q.to)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				name string
+				n    int64
+			)
+			if err = rows.Scan(&name, &n); err != nil {
+				return nil, err
+			}
+			counts[name] = n
+		}
+		return counts, rows.Err()
+	case RECORD_IN_SQLITE:
+		files := catalog.Load().AssetNames("", "")
+		args := []interface{}{sqliteTime(q.from), sqliteTime(q.to)}
+		for _, f := range files {
+			args = append(args, "/"+f)
+		}
+		stmt, err := sdb.Prepare(`
+			SELECT substr(path, 2), count(*)
+			FROM (
+				SELECT substr(request, 1, instr(request || '?', '?') - 1) AS path
+				FROM download_log
+				WHERE datetime(request_time) >= ? AND datetime(request_time) < ?
+					AND request_type = 'GET'
+					AND coalesce(completed, status = 200)
+					AND coalesce(ua_class, '') <> 'bot'
+			)
+			WHERE path IN (` + strings.TrimSuffix(strings.Repeat("?, ", len(files)), ", ") + `)
+			GROUP BY 1`)
+		if err != nil {
+			return nil, err
+		}
+		defer stmt.Finalize()
+		err = stmt.Select(func(s *sqlite.Stmt) (err error) {
+			name, _ := s.ScanText(0)
+			counts[name], _, err = s.ScanInt64(1)
+			return
+		}, args...)
+		return counts, err
+	}
+	return nil, errNoStatsDatabase
+}
+
+// githubDownloadsPerFile returns the number of downloads of each GitHub release asset over the time period, worked
+// out from the snapshots taken by the "collect-github" command.  The note explains any limitations of the numbers
+func githubDownloadsPerFile(ctx context.Context, q statsQuery) (counts map[string]int64, note string, err error) {
+	if RecordDownloadsLocation != RECORD_IN_PG {
+		return nil, "GitHub download counts are only available when using PostgreSQL", nil
+	}
+
+	// Find the snapshots taken just before the start and end of the time period
+	snapshot := func(before time.Time) (id *int, at *time.Time, err error) {
+		err = DB.QueryRow(ctx, `
+			SELECT max(timestamp_id), max(count_timestamp)
+			FROM (
+				SELECT timestamp_id, count_timestamp
+				FROM github_download_timestamps
+				WHERE count_timestamp < $1
+				ORDER BY count_timestamp DESC
+				LIMIT 1
+			) s`, before).Scan(&id, &at)
+		return
+	}
+	startID, _, err := snapshot(q.from)
+	if err != nil {
+		return
+	}
+	endID, endTime, err := snapshot(q.to)
+	if err != nil {
+		return
+	}
+	if endID == nil {
+		return nil, "There are no GitHub download count snapshots for this time period", nil
+	}
+	if startID == nil {
+		note = "There's no GitHub download count snapshot from before the start of this time period, so the GitHub " +
+			"numbers include all earlier downloads too"
+	} else if endTime.Before(q.to.AddDate(0, 0, -1)) {
+		note = fmt.Sprintf("The last GitHub download count snapshot in this time period is from %s",
+			endTime.UTC().Format(time.DateOnly))
+	}
+
+	// The downloads during the time period are the difference between the two snapshots
+	rows, err := DB.Query(ctx, `
+		SELECT a.asset_name, e.download_count - coalesce(s.download_count, 0)
+		FROM github_download_counts e
+			JOIN github_release_assets a ON a.asset_id = e.asset
+			LEFT JOIN github_download_counts s ON s.asset = e.asset AND s.count_timestamp = $2
+		WHERE e.count_timestamp = $1`, *endID, startID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	counts = make(map[string]int64)
+	for rows.Next() {
+		var (
+			name string
+			n    int64
+		)
+		if err = rows.Scan(&name, &n); err != nil {
+			return
+		}
+		counts[name] = n
+	}
+	return counts, note, rows.Err()
+}
+
+// groupDownloads totals up the downloads of each file by release (in catalog order, newest first) and by platform
+// (most downloaded first).  Releases and platforms without any downloads are left out
+func groupDownloads(cat *ReleaseCatalog, perFile, github map[string]int64) (releases, platforms []dashboardRow) {
+	platformRows := make(map[string]*dashboardRow)
+	add := func(row *dashboardRow, a CatalogAsset) {
+		d, g := perFile[a.Name], github[a.Name]
+		row.Downloads += d
+		row.GitHub += g
+		platform := a.OS
+		if platform == "" {
+			platform = "other"
+		}
+		p, ok := platformRows[platform]
+		if !ok {
+			p = &dashboardRow{Name: platform}
+			platformRows[platform] = p
+		}
+		p.Downloads += d
+		p.GitHub += g
+	}
+	for _, r := range cat.Releases {
+		row := dashboardRow{Name: r.Version}
+		for _, a := range r.Assets {
+			add(&row, a)
+		}
+		if row.Downloads > 0 || row.GitHub > 0 {
+			releases = append(releases, row)
+		}
+	}
+	other := dashboardRow{Name: "other files"}
+	for _, a := range cat.Files {
+		add(&other, a)
+	}
+	if other.Downloads > 0 || other.GitHub > 0 {
+		releases = append(releases, other)
+	}
+	for _, p := range platformRows {
+		if p.Downloads > 0 || p.GitHub > 0 {
+			platforms = append(platforms, *p)
+		}
+	}
+	slices.SortFunc(platforms, func(a, b dashboardRow) int {
+		if a.Downloads != b.Downloads {
+			return cmp.Compare(b.Downloads, a.Downloads)
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return
+}
+
+// svgColumnChart draws a column chart of stats over time
+func svgColumnChart(points []statsPoint) template.HTML {
+	if len(points) == 0 {
+		return `<p class="note">No data for this time period</p>`
+	}
+	const width, height, left, bottom = 800, 220, 50, 40
+	var maxCount int64 = 1
+	for _, p := range points {
+		maxCount = max(maxCount, p.Count)
+	}
+	colWidth := float64(width-left) / float64(len(points))
+	labelEvery := max(1, len(points)/12)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" role="img">`, width, height+bottom)
+	fmt.Fprintf(&b, `<line class="axis" x1="%d" y1="%d" x2="%d" y2="%d"/>`, left, height, width, height)
+	fmt.Fprintf(&b, `<text x="%d" y="12" text-anchor="end">%d</text>`, left-5, maxCount)
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">0</text>`, left-5, height)
+	for i, p := range points {
+		h := float64(p.Count) / float64(maxCount) * (height - 10)
+		x := float64(left) + float64(i)*colWidth
+		fmt.Fprintf(&b, `<rect class="bar" x="%.1f" y="%.1f" width="%.1f" height="%.1f"><title>%s: %d</title></rect>`,
+			x+colWidth*0.1, height-h, colWidth*0.8, h, template.HTMLEscapeString(p.Date), p.Count)
+		if i%labelEvery == 0 {
+			fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle">%s</text>`, x+colWidth/2, height+15,
+				template.HTMLEscapeString(p.Date))
+		}
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// svgBarChart draws a horizontal bar chart of download totals, optionally with the GitHub totals alongside
+func svgBarChart(rows []dashboardRow, github bool) template.HTML {
+	if len(rows) == 0 {
+		return `<p class="note">No data for this time period</p>`
+	}
+	const width, left, rowHeight = 800, 110, 22
+	var maxCount int64 = 1
+	for _, r := range rows {
+		maxCount = max(maxCount, r.Downloads, r.GitHub)
+	}
+	barHeight := float64(rowHeight - 6)
+	if github {
+		barHeight /= 2
+	}
+	scale := float64(width-left-60) / float64(maxCount)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" role="img">`, width,
+		len(rows)*rowHeight)
+	for i, r := range rows {
+		y := float64(i * rowHeight)
+		name := template.HTMLEscapeString(r.Name)
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`, left-5, y+rowHeight/2+4, name)
+		fmt.Fprintf(&b, `<rect class="bar" x="%d" y="%.1f" width="%.1f" height="%.1f"><title>%s: %d downloads</title></rect>`,
+			left, y+3, float64(r.Downloads)*scale, barHeight, name, r.Downloads)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f">%d</text>`, float64(left)+float64(r.Downloads)*scale+4,
+			y+3+barHeight-2, r.Downloads)
+		if github {
+			fmt.Fprintf(&b, `<rect class="bar github" x="%d" y="%.1f" width="%.1f" height="%.1f"><title>%s: %d GitHub downloads</title></rect>`,
+				left, y+3+barHeight, float64(r.GitHub)*scale, barHeight, name, r.GitHub)
+			fmt.Fprintf(&b, `<text x="%.1f" y="%.1f">%d</text>`, float64(left)+float64(r.GitHub)*scale+4,
+				y+3+2*barHeight-2, r.GitHub)
+		}
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
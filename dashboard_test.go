@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDashboard(t *testing.T) {
+	router := statsTestRouter(t)
+	get := func(url string, auth bool) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		if auth {
+			req.SetBasicAuth("stats", "secret")
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Web browsers should be asked for the password
+	w := get("/stats", false)
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, `Basic realm="stats"`, w.Header().Get("WWW-Authenticate"))
+
+	w = get("/stats?from=2024-10-14&to=2024-10-21&github=1", true)
+	assert.Equal(t, 200, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, "5 downloads from 2024-10-14 to 2024-10-21")
+	assert.Contains(t, body, "<svg")
+	assert.Contains(t, body, "<title>2024-10-14: 2</title>")
+	assert.Contains(t, body, "<tr><td>3.13.1</td><td>3</td><td>0</td></tr>")
+	assert.Contains(t, body, "<tr><td>3.13.0</td><td>2</td><td>0</td></tr>")
+	assert.Contains(t, body, "<tr><td>windows</td><td>4</td><td>0</td></tr>")
+	assert.Contains(t, body, "<tr><td>macos</td><td>1</td><td>0</td></tr>")
+	assert.Contains(t, body, "GitHub download counts are only available when using PostgreSQL")
+	assert.NotContains(t, body, "//cdn")
+
+	// Query strings on the download links don't stop them being counted
+	writeDownloads([]downloadRecord{{
+		ClientIPv4:    pgtype.Text{String: "192.0.2.8", Valid: true},
+		RequestTime:   time.Date(2024, 10, 22, 10, 0, 0, 0, time.UTC),
+		RequestType:   "GET",
+		Request:       "/DB.Browser.for.SQLite-v3.13.1.dmg?utm_source=sqlitebrowser.org",
+		Protocol:      "HTTP/1.1",
+		Status:        200,
+		HTTPUserAgent: "test",
+		EventID:       newEventID(),
+	}})
+	w = get("/stats?from=2024-10-22&to=2024-10-22", true)
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "<tr><td>macos</td><td>1</td></tr>")
+
+	w = get("/stats?granularity=year", true)
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "unknown granularity")
+
+	// The static files are built in
+	w = get("/stats/static/stats.css", true)
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "svg .bar")
+}
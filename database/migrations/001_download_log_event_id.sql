@@ -0,0 +1,6 @@
+-- Adds a unique identifier to each download_log entry.  This lets download records saved in the
+-- local journal (while PostgreSQL was unavailable) be replayed without creating duplicate entries.
+
+ALTER TABLE public.download_log ADD COLUMN event_id text;
+
+CREATE UNIQUE INDEX download_log_event_id_uindex ON public.download_log USING btree (event_id);
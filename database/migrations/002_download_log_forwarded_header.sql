@@ -0,0 +1,5 @@
+-- Keeps the proxy forwarding headers (Forwarded and X-Forwarded-For) of each request as received.
+-- The client address columns are now worked out from these only when the request came from a
+-- trusted proxy, so the original headers are kept for investigating anything unusual.
+
+ALTER TABLE public.download_log ADD COLUMN forwarded_header text;
@@ -0,0 +1,21 @@
+-- Links db4s_download_info to the file names in the release catalog (and the release each file is
+-- part of), so the stats tables can be filled in from download_log by the "aggregate" command.
+-- Existing db4s_download_info entries can be linked up by setting their file_name by hand.
+
+ALTER TABLE public.db4s_download_info ADD COLUMN file_name text;
+ALTER TABLE public.db4s_download_info ADD COLUMN db4s_release integer;
+
+CREATE UNIQUE INDEX db4s_download_info_file_name_uindex ON public.db4s_download_info USING btree (file_name);
+
+ALTER TABLE ONLY public.db4s_download_info
+    ADD CONSTRAINT db4s_download_info_db4s_release_info_release_id_fk FOREIGN KEY (db4s_release) REFERENCES public.db4s_release_info(release_id) ON UPDATE CASCADE ON DELETE SET NULL;
+
+-- Keeps track of how far through download_log the aggregation has got
+CREATE TABLE public.db4s_aggregate_state (
+    name text NOT NULL,
+    last_download_id bigint NOT NULL,
+    aggregated_until timestamp with time zone NOT NULL
+);
+
+ALTER TABLE ONLY public.db4s_aggregate_state
+    ADD CONSTRAINT db4s_aggregate_state_pk PRIMARY KEY (name);
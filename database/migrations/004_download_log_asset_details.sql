@@ -0,0 +1,8 @@
+-- Details of the DB4S download requested, worked out from the file name when the download is logged.
+-- Rows recorded before this can be filled in with the "backfill-assets" command.
+
+ALTER TABLE public.download_log ADD COLUMN asset_version text;
+ALTER TABLE public.download_log ADD COLUMN asset_os text;
+ALTER TABLE public.download_log ADD COLUMN asset_arch text;
+ALTER TABLE public.download_log ADD COLUMN asset_package text;
+ALTER TABLE public.download_log ADD COLUMN asset_portable boolean;
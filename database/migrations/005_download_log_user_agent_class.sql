@@ -0,0 +1,8 @@
+-- Classification of each download's user agent (kind of client, client name, and operating system
+-- family), using the rules in useragents.toml when the download is logged.  Downloads classified as
+-- bots aren't included in the stats tables.  Rows recorded before this can be classified with the
+-- "backfill" command.
+
+ALTER TABLE public.download_log ADD COLUMN ua_class text;
+ALTER TABLE public.download_log ADD COLUMN ua_name text;
+ALTER TABLE public.download_log ADD COLUMN ua_os text;
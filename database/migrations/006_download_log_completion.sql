@@ -0,0 +1,12 @@
+-- How much of each file was sent, and whether the request completed a download of it.  Range requests
+-- from the same client for the same file are coalesced into one logical download, sharing the
+-- download_group of the first of them, with only the request completing the file marked as completed.
+-- Only completed downloads are counted in the stats tables.  Rows recorded before this have a NULL
+-- completed column, and are counted if their status was 200.
+
+ALTER TABLE public.download_log ADD COLUMN range_start bigint;
+ALTER TABLE public.download_log ADD COLUMN range_end bigint;
+ALTER TABLE public.download_log ADD COLUMN file_size bigint;
+ALTER TABLE public.download_log ADD COLUMN file_bytes_sent bigint;
+ALTER TABLE public.download_log ADD COLUMN completed boolean;
+ALTER TABLE public.download_log ADD COLUMN download_group text;
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sqlite "github.com/gwenn/gosqlite"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// downloadRecord holds the details of a single request, ready for recording in the download_log table
+type downloadRecord struct {
+	ClientIPv4      pgtype.Text `json:"client_ipv4"`
+	ClientIPv6      pgtype.Text `json:"client_ipv6"`
+	ClientIPStrange pgtype.Text `json:"client_ip_strange"`
+	ClientPort      pgtype.Int4 `json:"client_port"`
+	RemoteUser      pgtype.Text `json:"remote_user"`
+	RequestTime     time.Time   `json:"request_time"`
+	RequestType     string      `json:"request_type"`
+	Request         string      `json:"request"`
+	Protocol        string      `json:"protocol"`
+	Status          int         `json:"status"`
+	BodyBytesSent   int         `json:"body_bytes_sent"`
+	HTTPReferer     pgtype.Text `json:"http_referer"`
+	HTTPUserAgent   string      `json:"http_user_agent"`
+	EventID         pgtype.Text `json:"event_id"`         // Unique identifier for the download, so it's never recorded twice
+	ForwardedHeader pgtype.Text `json:"forwarded_header"` // Forwarding headers added by proxies, as received
+	AssetVersion    pgtype.Text `json:"asset_version"`    // Details of the DB4S download requested, from its file name
+	AssetOS         pgtype.Text `json:"asset_os"`
+	AssetArch       pgtype.Text `json:"asset_arch"`
+	AssetPackage    pgtype.Text `json:"asset_package"`
+	AssetPortable   pgtype.Bool `json:"asset_portable"`
+	UAClass         pgtype.Text `json:"ua_class"` // Classification of the user agent, from the user agent rules
+	UAName          pgtype.Text `json:"ua_name"`
+	UAOS            pgtype.Text `json:"ua_os"`
+	RangeStart      pgtype.Int8 `json:"range_start"` // Byte range of the file served, for range requests
+	RangeEnd        pgtype.Int8 `json:"range_end"`
+	FileSize        pgtype.Int8 `json:"file_size"`       // Size of the whole file
+	FileBytesSent   pgtype.Int8 `json:"file_bytes_sent"` // Bytes of the file sent, before any compression
+	Completed       pgtype.Bool `json:"completed"`       // Whether this request completed a download of the file
+	DownloadGroup   pgtype.Text `json:"download_group"`  // Event ID of the first request of a download made in pieces
+}
+
+var (
+	// The download_log columns written for each download record, in the order returned by downloadRecord.values()
+	downloadColumns = []string{
+		"client_ipv4", "client_ipv6", "client_ip_strange", "client_port", "remote_user", "request_time", "request_type",
+		"request", "protocol", "status", "body_bytes_sent", "http_referer", "http_user_agent", "event_id",
+		"forwarded_header", "asset_version", "asset_os", "asset_arch", "asset_package", "asset_portable",
+		"ua_class", "ua_name", "ua_os", "range_start", "range_end", "file_size", "file_bytes_sent", "completed",
+		"download_group",
+	}
+
+	// Position of the request time in downloadColumns
+	requestTimeColumn = slices.Index(downloadColumns, "request_time")
+
+	// Queue of download records waiting to be written to the database
+	downloadQueue chan downloadRecord
+
+	// Protects the download queue from being closed while records are still being added to it
+	downloadQueueMu     sync.RWMutex
+	downloadQueueClosed bool
+
+	// Closed by the background writer once it has written everything in the queue
+	downloadWriterDone chan struct{}
+
+	// Number of download records thrown away due to the queue being full
+	droppedDownloads atomic.Int64
+)
+
+// values returns the fields of a download record in the same order as downloadColumns
+func (r *downloadRecord) values() []interface{} {
+	return []interface{}{
+		r.ClientIPv4, r.ClientIPv6, r.ClientIPStrange, r.ClientPort, r.RemoteUser, r.RequestTime, r.RequestType,
+		r.Request, r.Protocol, r.Status, r.BodyBytesSent, r.HTTPReferer, r.HTTPUserAgent, r.EventID,
+		r.ForwardedHeader, r.AssetVersion, r.AssetOS, r.AssetArch, r.AssetPackage, r.AssetPortable,
+		r.UAClass, r.UAName, r.UAOS, r.RangeStart, r.RangeEnd, r.FileSize, r.FileBytesSent, r.Completed,
+		r.DownloadGroup,
+	}
+}
+
+// fields returns pointers to the fields of a download record in the same order as downloadColumns, for scanning
+// database rows into
+func (r *downloadRecord) fields() []interface{} {
+	return []interface{}{
+		&r.ClientIPv4, &r.ClientIPv6, &r.ClientIPStrange, &r.ClientPort, &r.RemoteUser, &r.RequestTime, &r.RequestType,
+		&r.Request, &r.Protocol, &r.Status, &r.BodyBytesSent, &r.HTTPReferer, &r.HTTPUserAgent, &r.EventID,
+		&r.ForwardedHeader, &r.AssetVersion, &r.AssetOS, &r.AssetArch, &r.AssetPackage, &r.AssetPortable,
+		&r.UAClass, &r.UAName, &r.UAOS, &r.RangeStart, &r.RangeEnd, &r.FileSize, &r.FileBytesSent, &r.Completed,
+		&r.DownloadGroup,
+	}
+}
+
+// scanSQLite fills in a download record from a row of the SQLite download_log table, with the columns starting at the
+// given position in the same order as downloadColumns
+func (r *downloadRecord) scanSQLite(s *sqlite.Stmt, first int) (err error) {
+	text := func(i int) pgtype.Text {
+		v, isNull := s.ScanText(first + i)
+		return pgtype.Text{String: v, Valid: !isNull}
+	}
+	str := func(i int) string {
+		v, _ := s.ScanText(first + i)
+		return v
+	}
+	integer := func(i int) (v int) {
+		if err == nil {
+			v, _, err = s.ScanInt(first + i)
+		}
+		return
+	}
+	int8 := func(i int) (v pgtype.Int8) {
+		if err == nil {
+			var isNull bool
+			v.Int64, isNull, err = s.ScanInt64(first + i)
+			v.Valid = !isNull
+		}
+		return
+	}
+	boolean := func(i int) (v pgtype.Bool) {
+		if err == nil {
+			var isNull bool
+			v.Bool, isNull, err = s.ScanBool(first + i)
+			v.Valid = !isNull
+		}
+		return
+	}
+	r.ClientIPv4, r.ClientIPv6, r.ClientIPStrange = text(0), text(1), text(2)
+	port, isNull, err := s.ScanInt32(first + 3)
+	r.ClientPort = pgtype.Int4{Int32: port, Valid: !isNull}
+	r.RemoteUser = text(4)
+	r.RequestType, r.Request, r.Protocol = str(6), str(7), str(8)
+	r.Status, r.BodyBytesSent = integer(9), integer(10)
+	r.HTTPReferer, r.HTTPUserAgent, r.EventID = text(11), str(12), text(13)
+	r.ForwardedHeader = text(14)
+	r.AssetVersion, r.AssetOS, r.AssetArch, r.AssetPackage = text(15), text(16), text(17), text(18)
+	r.UAClass, r.UAName, r.UAOS = text(20), text(21), text(22)
+	r.RangeStart, r.RangeEnd, r.FileSize, r.FileBytesSent = int8(23), int8(24), int8(25), int8(26)
+	r.DownloadGroup = text(28)
+	r.AssetPortable, r.Completed = boolean(19), boolean(27)
+	if err != nil {
+		return
+	}
+
+	// SQLite doesn't have a timestamp type, so the request time is stored as text
+	r.RequestTime, err = time.Parse(time.RFC3339Nano, str(requestTimeColumn))
+	return
+}
+
+// setLoggingDefaults fills in the download logging settings not given in the config file
+func setLoggingDefaults(l *LoggingInfo) {
+	if l.ReplayInterval <= 0 {
+		l.ReplayInterval = 60
+	}
+	if l.Journal == "" {
+		l.Journal = "DB4S_download_journal.jsonl"
+	}
+	if l.QueueSize <= 0 {
+		l.QueueSize = 10000
+	}
+	if l.BatchSize <= 0 {
+		l.BatchSize = 500
+	}
+	if l.FlushInterval <= 0 {
+		l.FlushInterval = 5
+	}
+	if l.RangeWindow <= 0 {
+		l.RangeWindow = 3600
+	}
+	switch l.QueueFull {
+	case "":
+		l.QueueFull = "drop"
+	case "drop", "block":
+	default:
+		log.Printf("Unknown queue_full setting '%s' for download logging, using 'drop' instead", l.QueueFull)
+		l.QueueFull = "drop"
+	}
+}
+
+// startDownloadLogger creates the download record queue, and starts the background writer which saves the queued
+// records to the database
+func startDownloadLogger() {
+	downloadQueueMu.Lock()
+	downloadQueue = make(chan downloadRecord, Conf.Logging.QueueSize)
+	downloadQueueClosed = false
+	downloadWriterDone = make(chan struct{})
+	downloadQueueMu.Unlock()
+	rangeDownloads = newRangeCoalescer(time.Duration(Conf.Logging.RangeWindow) * time.Second)
+	go downloadWriter(downloadQueue, Conf.Logging.BatchSize, time.Duration(Conf.Logging.FlushInterval)*time.Second)
+}
+
+// stopDownloadLogger stops accepting new download records, then waits for the background writer to save the ones
+// already queued
+func stopDownloadLogger() {
+	downloadQueueMu.Lock()
+	if downloadQueue == nil || downloadQueueClosed {
+		downloadQueueMu.Unlock()
+		return
+	}
+	downloadQueueClosed = true
+	close(downloadQueue)
+	downloadQueueMu.Unlock()
+
+	<-downloadWriterDone
+	if n := droppedDownloads.Load(); n > 0 {
+		log.Printf("%d download records were dropped due to the download log queue being full", n)
+	}
+}
+
+// queueDownload adds a download record to the queue for the background writer.  If the queue is full, the record is
+// either dropped or the caller waits for space, depending on the queue_full setting
+func queueDownload(rec downloadRecord) {
+	downloadQueueMu.RLock()
+	defer downloadQueueMu.RUnlock()
+	if downloadQueue == nil || downloadQueueClosed {
+		return
+	}
+	if Conf.Logging.QueueFull == "block" {
+		downloadQueue <- rec
+		return
+	}
+	select {
+	case downloadQueue <- rec:
+	default:
+		if droppedDownloads.Add(1)%1000 == 1 {
+			log.Printf("Download log queue is full, dropping records.  %d dropped so far", droppedDownloads.Load())
+		}
+	}
+}
+
+// downloadWriter saves the queued download records to the database in batches.  A batch is written once it's full,
+// or when the flush interval has passed, whichever comes first
+func downloadWriter(queue <-chan downloadRecord, batchSize int, flushInterval time.Duration) {
+	defer close(downloadWriterDone)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]downloadRecord, 0, batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		writeDownloads(batch)
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case rec, ok := <-queue:
+			if !ok {
+				// The queue has been closed, so write what's left and finish up
+				flush()
+				return
+			}
+			batch = append(batch, rec)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// writeDownloads saves a batch of download records to whichever database downloads are being recorded in
+func writeDownloads(batch []downloadRecord) {
+	switch RecordDownloadsLocation {
+	case RECORD_IN_PG:
+		rows := make([][]interface{}, 0, len(batch))
+		for i := range batch {
+			rows = append(rows, batch[i].values())
+		}
+		n, err := DB.CopyFrom(context.Background(), pgx.Identifier{"download_log"}, downloadColumns, pgx.CopyFromRows(rows))
+		if err != nil {
+			// Save the records in the local journal instead, to be replayed once PostgreSQL is working again
+			log.Printf("error when inserting %d download entries in PostgreSQL, saving them to the journal: %v", len(batch), err)
+			appendJournal(batch)
+			return
+		}
+		if n != int64(len(batch)) {
+			log.Printf("something went wrong when inserting new download entries.  # of entries affected = %d instead of %d", n, len(batch))
+		}
+	case RECORD_IN_SQLITE:
+		// Note there's no need to convert the PG data types before hand, as the SQLite library seems ok with them
+		err := sdb.Transaction(sqlite.Immediate, func(c *sqlite.Conn) error {
+			dbQuery := `INSERT INTO download_log (` + strings.Join(downloadColumns, ", ") + `)
+				VALUES (` + strings.TrimSuffix(strings.Repeat("?, ", len(downloadColumns)), ", ") + `)`
+			stmt, err := c.Prepare(dbQuery)
+			if err != nil {
+				return err
+			}
+			defer stmt.Finalize()
+			for i := range batch {
+				vals := batch[i].values()
+
+				// SQLite doesn't have a timestamp type, so we store the request time as text
+				vals[requestTimeColumn] = batch[i].RequestTime.UTC().Format(time.RFC3339Nano)
+				if err = stmt.Exec(vals...); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("error when inserting %d download entries in SQLite: %v", len(batch), err)
+		}
+	}
+}
+
+// insertNewDownloads inserts download records into PostgreSQL, skipping any whose event ID is already present there.
+// Returns the number of records skipped as duplicates
+func insertNewDownloads(ctx context.Context, recs []downloadRecord) (duplicates int64, err error) {
+	if len(recs) == 0 {
+		return
+	}
+	placeholders := make([]string, len(downloadColumns))
+	for i := range placeholders {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	dbQuery := `INSERT INTO download_log (` + strings.Join(downloadColumns, ", ") + `)
+		VALUES (` + strings.Join(placeholders, ", ") + `)
+		ON CONFLICT (event_id) DO NOTHING`
+	var batch pgx.Batch
+	for i := range recs {
+		batch.Queue(dbQuery, recs[i].values()...)
+	}
+	br := DB.SendBatch(ctx, &batch)
+	defer func() {
+		if err2 := br.Close(); err == nil {
+			err = err2
+		}
+	}()
+	for range recs {
+		res, err := br.Exec()
+		if err != nil {
+			return duplicates, err
+		}
+		if res.RowsAffected() == 0 {
+			duplicates++
+		}
+	}
+	return
+}
+
+// newEventID returns a random identifier for a download record
+func newEventID() pgtype.Text {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		// Should never happen, but if it does we still record the download, just without duplicate protection
+		log.Printf("Couldn't generate a download event ID: %v", err)
+		return pgtype.Text{Valid: false}
+	}
+	return pgtype.Text{String: hex.EncodeToString(b), Valid: true}
+}
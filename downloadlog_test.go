@@ -0,0 +1,49 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadLogger(t *testing.T) {
+	oldLocation, oldLogging := RecordDownloadsLocation, Conf.Logging
+	t.Cleanup(func() {
+		RecordDownloadsLocation, Conf.Logging = oldLocation, oldLogging
+	})
+
+	require.NoError(t, connectSQLite(filepath.Join(t.TempDir(), "downloads.sqlite")))
+	t.Cleanup(func() { sdb.Close() })
+	RecordDownloadsLocation = RECORD_IN_SQLITE
+
+	// Use a small batch size, and a flush interval long enough it won't be reached during the test
+	Conf.Logging = LoggingInfo{BatchSize: 2, FlushInterval: 3600, QueueFull: "block", QueueSize: 10}
+	startDownloadLogger()
+	for i := 0; i < 5; i++ {
+		queueDownload(downloadRecord{
+			ClientIPv4:    pgtype.Text{String: "192.0.2.1", Valid: true},
+			ClientPort:    pgtype.Int4{Int32: int32(40000 + i), Valid: true},
+			RequestTime:   time.Now(),
+			RequestType:   "GET",
+			Request:       "/DB.Browser.for.SQLite-v3.13.1-win64.msi",
+			Protocol:      "HTTP/1.1",
+			Status:        200,
+			BodyBytesSent: 1234,
+			HTTPUserAgent: "test",
+		})
+	}
+
+	// The last record doesn't fill a batch, so it's only written when the logger is stopped
+	stopDownloadLogger()
+	var n int
+	err := sdb.OneValue(`SELECT count(*) FROM download_log WHERE client_ipv4 = '192.0.2.1' AND status = 200`, &n)
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+
+	// Records queued after stopping are ignored, rather than causing a panic
+	queueDownload(downloadRecord{})
+}
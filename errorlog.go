@@ -6,8 +6,9 @@ import (
 )
 
 var (
-	// Our custom http error logger
-	httpErrorLogger *log.Logger
+	// Our custom http error logger, shared by all of the servers.  It leaves the timestamps to the standard logger,
+	// which the messages that get through the filter are passed on to
+	httpErrorLogger = log.New(&FilteringErrorLogWriter{}, "", 0)
 )
 
 // FilteringErrorLogWriter is a custom error logger for our http servers, to filter out the copious
@@ -18,7 +19,7 @@ type FilteringErrorLogWriter struct{}
 func (*FilteringErrorLogWriter) Write(msg []byte) (int, error) {
 	z := string(msg)
 	if !(strings.HasPrefix(z, "http: TLS handshake error") && strings.HasSuffix(z, ": EOF\n")) {
-		err := httpErrorLogger.Output(0, z)
+		err := log.Output(2, z)
 		if err != nil {
 			log.Println(err)
 		}
@@ -28,6 +29,5 @@ func (*FilteringErrorLogWriter) Write(msg []byte) (int, error) {
 
 // HttpErrorLog filters out the copious 'TLS handshake error' messages we're getting
 func HttpErrorLog() *log.Logger {
-	httpErrorLogger = log.New(&FilteringErrorLogWriter{}, "", log.LstdFlags)
 	return httpErrorLogger
 }
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHttpErrorLog(t *testing.T) {
+	var buf bytes.Buffer
+	out := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(out) })
+
+	// Every server shares the same logger
+	assert.Same(t, HttpErrorLog(), HttpErrorLog())
+
+	// The TLS handshake errors from clients going away are dropped, with everything else passed through
+	HttpErrorLog().Printf("http: TLS handshake error from 192.0.2.1:54321: EOF")
+	assert.Empty(t, buf.String())
+	HttpErrorLog().Printf("http: panic serving 192.0.2.1:54321: oops")
+	assert.Contains(t, buf.String(), "http: panic serving 192.0.2.1:54321: oops\n")
+	assert.Equal(t, 1, bytes.Count(buf.Bytes(), []byte("\n")))
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	sqlite "github.com/gwenn/gosqlite"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// exportOptions selects which download_log rows to export, and how
+type exportOptions struct {
+	from, to     time.Time // Request time range.  The "to" time isn't included
+	files        string    // Glob pattern the requested file name needs to match, eg "*.dmg".  Empty for all requests
+	status       int       // Only include requests with this HTTP status.  0 for all of them
+	format       string    // "csv", "ndjson", or "parquet"
+	pseudonymise bool      // Replace the client IP addresses with pseudonyms
+}
+
+// exportContentTypes are the MIME types of the export formats
+var exportContentTypes = map[string]string{
+	"csv":     "text/csv; charset=utf-8",
+	"ndjson":  "application/x-ndjson",
+	"parquet": "application/vnd.apache.parquet",
+}
+
+// exportWriter writes exported download records in one of the export formats
+type exportWriter interface {
+	write(r *downloadRecord) error
+	close() error
+}
+
+// parseExportOptions checks and converts the export options given on the command line or in an export request.  The
+// dates are in YYYY-MM-DD format, and default to the last 30 days
+func parseExportOptions(fromDate, toDate, files, status, format string) (opts exportOptions, err error) {
+	from, to, err := parseDateRange(fromDate, toDate)
+	if err != nil {
+		return
+	}
+	opts.from, opts.to = periodStart("day", from), periodEnd("day", to)
+	opts.files = files
+	if status != "" {
+		opts.status, err = strconv.Atoi(status)
+		if err != nil || opts.status < 100 || opts.status > 599 {
+			return opts, fmt.Errorf("invalid HTTP status '%s'", status)
+		}
+	}
+	opts.format = strings.ToLower(format)
+	if opts.format == "" {
+		opts.format = "csv"
+	}
+	if _, ok := exportContentTypes[opts.format]; !ok {
+		return opts, fmt.Errorf("unknown export format '%s', it should be csv, ndjson, or parquet", format)
+	}
+	return
+}
+
+// exportCommand writes the download_log rows matching the given options to a file, or to stdout
+func exportCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	fromDate := flags.String("from", "", "First date (YYYY-MM-DD) to export.  Defaults to 29 days before the -to date")
+	toDate := flags.String("to", "", "Last date (YYYY-MM-DD) to export.  Defaults to today")
+	files := flags.String("files", "", "Only export requests for file names matching this pattern, eg \"*.dmg\"")
+	status := flags.String("status", "", "Only export requests with this HTTP status, eg 200")
+	format := flags.String("format", "csv", "Export format.  csv, ndjson, or parquet")
+	pseudonymise := flags.Bool("pseudonymise", false, "Replace the client IP addresses with pseudonyms")
+	output := flags.String("o", "", "File to write the export to.  Defaults to stdout")
+	sqliteFile := flags.String("sqlite", "", "Export from this SQLite database instead of PostgreSQL")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+	opts, err := parseExportOptions(*fromDate, *toDate, *files, *status, *format)
+	if err != nil {
+		return
+	}
+	opts.pseudonymise = *pseudonymise
+
+	// Open the database to export from
+	if *sqliteFile != "" {
+		sdb, err = sqlite.Open(*sqliteFile, sqlite.OpenReadOnly)
+		if err != nil {
+			return fmt.Errorf("couldn't open SQLite database '%s': %w", *sqliteFile, err)
+		}
+		defer sdb.Close()
+		RecordDownloadsLocation = RECORD_IN_SQLITE
+	} else {
+		err = connectPostgreSQL()
+		if err == nil {
+			defer DB.Close()
+			err = DB.Ping(context.Background())
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't connect to PostgreSQL: %w", err)
+		}
+		RecordDownloadsLocation = RECORD_IN_PG
+	}
+
+	// Write the export
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		var f *os.File
+		f, err = os.Create(*output)
+		if err != nil {
+			return
+		}
+		defer func() {
+			if err2 := f.Close(); err == nil {
+				err = err2
+			}
+		}()
+		out = f
+	}
+	n, err := exportDownloads(context.Background(), out, opts)
+	if err != nil {
+		return
+	}
+	if *output != "" {
+		fmt.Printf("Exported %d downloads to '%s'\n", n, *output)
+	}
+	return
+}
+
+// Gin context key set by exportAuth when the request has the export token
+const rawExportKey = "db4s_raw_export"
+
+// exportAuth lets through export requests with either the export token or the stats API token.  The stats API token is
+// shared with the dashboards, so only requests with the export token can have the real client addresses
+func exportAuth() gin.HandlerFunc {
+	apiAuth := tokenAuth("Bearer")
+	return func(c *gin.Context) {
+		if hasToken(c, liveConf.Load().exportToken) {
+			c.Set(rawExportKey, true)
+			c.Next()
+			return
+		}
+		apiAuth(c)
+	}
+}
+
+// exportHandler streams the download_log rows matching the query parameters to the client.  The options are the same
+// as for the export command, except the client addresses are pseudonymised unless "pseudonymise=false" is given along
+// with the export token
+func exportHandler(c *gin.Context) {
+	opts, err := parseExportOptions(c.Query("from"), c.Query("to"), c.Query("files"), c.Query("status"),
+		c.Query("format"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	opts.pseudonymise, err = strconv.ParseBool(c.DefaultQuery("pseudonymise", "true"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid pseudonymise value '%s'",
+			c.Query("pseudonymise"))})
+		return
+	}
+	if !opts.pseudonymise && !c.GetBool(rawExportKey) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "exports with the real client addresses need the export token"})
+		return
+	}
+	if RecordDownloadsLocation == RECORD_NOWHERE {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "downloads aren't being recorded, so there's nothing to export"})
+		return
+	}
+
+	// Once the rows start being sent the status can't be changed any more, so errors part way through can only be
+	// logged
+	c.Header("Content-Type", exportContentTypes[opts.format])
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="download_log_%s_%s.%s"`,
+		opts.from.Format(time.DateOnly), opts.to.AddDate(0, 0, -1).Format(time.DateOnly), opts.format))
+	c.Status(http.StatusOK)
+	_, err = exportDownloads(c.Request.Context(), transferWriter(c), opts)
+	if err != nil {
+		log.Printf("Error when exporting the download log for '%s': %v", c.Request.URL, err)
+	}
+}
+
+// exportDownloads writes the matching download_log rows to w in the requested format, returning the number written.
+// The rows are read and written one at a time, so the whole table is never held in memory
+func exportDownloads(ctx context.Context, w io.Writer, opts exportOptions) (n int64, err error) {
+	var ew exportWriter
+	switch opts.format {
+	case "csv":
+		ew, err = newCSVExport(w)
+	case "ndjson":
+		ew = &ndjsonExport{enc: json.NewEncoder(w)}
+	case "parquet":
+		ew, err = newParquetExport(w)
+	}
+	if err != nil {
+		return
+	}
+	var p *pseudonymiser
+	if opts.pseudonymise {
+		p, err = newPseudonymiser(liveConf.Load().pseudonymKey)
+		if err != nil {
+			return
+		}
+	}
+	each := func(r *downloadRecord) error {
+		if p != nil {
+			p.apply(r)
+		}
+		n++
+		return ew.write(r)
+	}
+	switch RecordDownloadsLocation {
+	case RECORD_IN_PG:
+		err = exportPostgreSQL(ctx, opts, each)
+	case RECORD_IN_SQLITE:
+		err = exportSQLite(sdb, opts, each)
+	default:
+		err = errors.New("no database to export from")
+	}
+	if err != nil {
+		return
+	}
+	return n, ew.close()
+}
+
+// exportPostgreSQL reads the matching rows from the PostgreSQL download_log table, passing each to the given function
+func exportPostgreSQL(ctx context.Context, opts exportOptions, each func(r *downloadRecord) error) (err error) {
+	// Older rows can have NULLs in columns which are always filled in now, so those are given their zero value
+	var r downloadRecord
+	names := make([]string, 0, len(downloadColumns))
+	for i, v := range r.values() {
+		switch v.(type) {
+		case string:
+			names = append(names, fmt.Sprintf("coalesce(%s, '')", downloadColumns[i]))
+		case int:
+			names = append(names, fmt.Sprintf("coalesce(%s, 0)", downloadColumns[i]))
+		default:
+			names = append(names, downloadColumns[i])
+		}
+	}
+	rows, err := DB.Query(ctx, `
+		SELECT `+strings.Join(names, ", ")+`
+		FROM download_log
+		WHERE request_time >= $1 AND request_time < $2
+			AND ($3 = '' OR ltrim(split_part(request, '?', 1), '/') LIKE $3 ESCAPE '\')
+			AND ($4 = 0 OR status = $4)
+		ORDER BY request_time, download_id`, opts.from, opts.to, globToLike(opts.files), opts.status)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r = downloadRecord{}
+		err = rows.Scan(r.fields()...)
+		if err != nil {
+			return
+		}
+		err = each(&r)
+		if err != nil {
+			return
+		}
+	}
+	return rows.Err()
+}
+
+// exportSQLite reads the matching rows from a SQLite download_log table, passing each to the given function.  Note the
+// SQLite library passes empty strings as NULL
+func exportSQLite(conn *sqlite.Conn, opts exportOptions, each func(r *downloadRecord) error) (err error) {
+	selectList, err := sqliteSelectList(conn)
+	if err != nil {
+		return
+	}
+	stmt, err := conn.Prepare(`
+		SELECT ` + selectList + `
+		FROM download_log
+		WHERE datetime(request_time) >= ? AND datetime(request_time) < ?
+			AND (coalesce(?, '') = ''
+				OR ltrim(CASE WHEN instr(request, '?') > 0 THEN substr(request, 1, instr(request, '?') - 1) ELSE request END, '/')
+					LIKE ? ESCAPE '\')
+			AND (? = 0 OR status = ?)
+		ORDER BY datetime(request_time), download_id`)
+	if err != nil {
+		return
+	}
+	defer stmt.Finalize()
+	pattern := globToLike(opts.files)
+	return stmt.Select(func(s *sqlite.Stmt) (err error) {
+		var r downloadRecord
+		err = r.scanSQLite(s, 0)
+		if err != nil {
+			return
+		}
+		return each(&r)
+	}, sqliteTime(opts.from), sqliteTime(opts.to), pattern, pattern, opts.status, opts.status)
+}
+
+// globToLike converts a file name pattern using * and ? wildcards into a SQL LIKE pattern, escaped with \
+func globToLike(glob string) string {
+	var b strings.Builder
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteRune('%')
+		case '?':
+			b.WriteRune('_')
+		case '%', '_', '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// exportValue converts a download record field into a plain string, int32, int64, bool, or time value, or nil for NULL
+func exportValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case pgtype.Text:
+		if !v.Valid {
+			return nil
+		}
+		return v.String
+	case pgtype.Int4:
+		if !v.Valid {
+			return nil
+		}
+		return v.Int32
+	case pgtype.Int8:
+		if !v.Valid {
+			return nil
+		}
+		return v.Int64
+	case pgtype.Bool:
+		if !v.Valid {
+			return nil
+		}
+		return v.Bool
+	case int:
+		return int64(v)
+	case string, time.Time:
+		return v
+	}
+	panic(fmt.Sprintf("export of %T values isn't supported", v))
+}
+
+// csvExport writes the export as CSV, with a header row of the column names.  NULLs are written as empty values
+type csvExport struct {
+	w *csv.Writer
+}
+
+func newCSVExport(w io.Writer) (*csvExport, error) {
+	e := &csvExport{w: csv.NewWriter(w)}
+	return e, e.w.Write(downloadColumns)
+}
+
+func (e *csvExport) write(r *downloadRecord) error {
+	row := make([]string, len(downloadColumns))
+	for i, v := range r.values() {
+		switch v := exportValue(v).(type) {
+		case string:
+			row[i] = v
+		case int32:
+			row[i] = strconv.FormatInt(int64(v), 10)
+		case int64:
+			row[i] = strconv.FormatInt(v, 10)
+		case bool:
+			row[i] = strconv.FormatBool(v)
+		case time.Time:
+			row[i] = v.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return e.w.Write(row)
+}
+
+func (e *csvExport) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// ndjsonExport writes the export as one JSON object per line, in the same format as the download journal
+type ndjsonExport struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonExport) write(r *downloadRecord) error {
+	return e.enc.Encode(r)
+}
+
+func (e *ndjsonExport) close() error {
+	return nil
+}
+
+// parquetExport writes the export as a Parquet file, with a column for each download_log column
+type parquetExport struct {
+	pw *writer.CSVWriter
+}
+
+// newParquetExport starts a Parquet export.  The Parquet column types are worked out from the download record field
+// types.  The row groups are kept fairly small, as each one is held in memory until it's complete
+func newParquetExport(w io.Writer) (e *parquetExport, err error) {
+	var r downloadRecord
+	schema := make([]string, len(downloadColumns))
+	for i, v := range r.values() {
+		var colType string
+		switch v.(type) {
+		case pgtype.Text:
+			colType = "type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"
+		case pgtype.Int4:
+			colType = "type=INT32, repetitiontype=OPTIONAL"
+		case pgtype.Int8:
+			colType = "type=INT64, repetitiontype=OPTIONAL"
+		case pgtype.Bool:
+			colType = "type=BOOLEAN, repetitiontype=OPTIONAL"
+		case string:
+			colType = "type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=REQUIRED"
+		case int:
+			colType = "type=INT64, repetitiontype=REQUIRED"
+		case time.Time:
+			colType = "type=INT64, convertedtype=TIMESTAMP_MICROS, repetitiontype=REQUIRED"
+		default:
+			return nil, fmt.Errorf("export of %T values isn't supported", v)
+		}
+		schema[i] = fmt.Sprintf("name=%s, %s", downloadColumns[i], colType)
+	}
+	e = &parquetExport{}
+	e.pw, err = writer.NewCSVWriterFromWriter(schema, w, 1)
+	if err != nil {
+		return nil, err
+	}
+	e.pw.RowGroupSize = 16 * 1024 * 1024
+	return
+}
+
+func (e *parquetExport) write(r *downloadRecord) error {
+	row := make([]interface{}, len(downloadColumns))
+	for i, v := range r.values() {
+		v = exportValue(v)
+		if t, ok := v.(time.Time); ok {
+			v = t.UnixMicro()
+		}
+		row[i] = v
+	}
+	return e.pw.Write(row)
+}
+
+func (e *parquetExport) close() error {
+	return e.pw.WriteStop()
+}
+
+// pseudonymiser replaces client IP addresses with a keyed hash of them, so the same address always gets the same
+// pseudonym (letting unique users be counted) without the address itself being given out
+type pseudonymiser struct {
+	key []byte
+}
+
+// newPseudonymiser creates a pseudonymiser using the given key.  With no key a random one is used, so the pseudonyms
+// can only be compared within a single export
+func newPseudonymiser(key string) (*pseudonymiser, error) {
+	k := []byte(key)
+	if key == "" {
+		k = make([]byte, 32)
+		if _, err := rand.Read(k); err != nil {
+			return nil, err
+		}
+	}
+	return &pseudonymiser{key: k}, nil
+}
+
+// pseudonym returns the pseudonym for a client IP address
+func (p *pseudonymiser) pseudonym(addr string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(addr))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// apply pseudonymises the client IP addresses of a download record.  The client port and forwarding headers are
+// removed, as they could be used to identify the client as well
+func (p *pseudonymiser) apply(r *downloadRecord) {
+	for _, t := range []*pgtype.Text{&r.ClientIPv4, &r.ClientIPv6, &r.ClientIPStrange} {
+		if t.Valid {
+			t.String = p.pseudonym(t.String)
+		}
+	}
+	r.ClientPort = pgtype.Int4{}
+	r.ForwardedHeader = pgtype.Text{}
+}
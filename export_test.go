@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func TestExport(t *testing.T) {
+	router := statsTestRouter(t)
+	Conf.Stats.ExportToken = "export secret"
+	liveConf.Store(newLiveSettings(Conf))
+	getWith := func(token, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+		return w
+	}
+	get := func(url string) *httptest.ResponseRecorder {
+		return getWith("secret", url)
+	}
+	column := func(name string) int {
+		return slices.Index(downloadColumns, name)
+	}
+
+	// CSV, with a header row followed by the matching downloads in request time order.  The real client addresses
+	// need the export token
+	w := getWith("export secret", "/api/export?from=2024-10-14&to=2024-10-31&files=*.msi&status=200&pseudonymise=false")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), `filename="download_log_2024-10-14_2024-10-31.csv"`)
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 5)
+	assert.Equal(t, downloadColumns, rows[0])
+	var requests, ips []string
+	for _, row := range rows[1:] {
+		requests = append(requests, row[column("request")])
+		ips = append(ips, row[column("client_ipv4")])
+	}
+	assert.Equal(t, []string{"/DB.Browser.for.SQLite-v3.13.1-win64.msi", "/DB.Browser.for.SQLite-v3.13.1-win64.msi",
+		"/DB.Browser.for.SQLite-v3.13.0-win64.msi", "/DB.Browser.for.SQLite-v3.13.0-win64.msi"}, requests)
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.2", "192.0.2.5", "192.0.2.7"}, ips)
+	assert.Equal(t, []string{"", "false"}, []string{rows[3][column("completed")], rows[4][column("completed")]})
+	assert.Equal(t, "2024-10-14T10:00:00Z", rows[1][column("request_time")])
+
+	// Query strings are ignored when matching file names, and the dates are inclusive
+	w = getWith("export secret", "/api/export?format=ndjson&from=2024-10-14&to=2024-10-14&files=currentrelease&pseudonymise=0")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var recs []downloadRecord
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var r downloadRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &r))
+		recs = append(recs, r)
+	}
+	require.Len(t, recs, 4)
+	assert.Equal(t, "/currentrelease?os=windows", recs[2].Request)
+
+	// Pseudonymised addresses are consistent within an export, but don't give away the address.  Exports with the stats
+	// API token are always pseudonymised, as are ones with the export token unless asked otherwise
+	for _, w := range []*httptest.ResponseRecorder{
+		get("/api/export?format=ndjson&from=2024-10-14&to=2024-10-14&files=currentrelease"),
+		get("/api/export?format=ndjson&from=2024-10-14&to=2024-10-14&files=currentrelease&pseudonymise=true"),
+		getWith("export secret", "/api/export?format=ndjson&from=2024-10-14&to=2024-10-14&files=currentrelease"),
+	} {
+		require.Equal(t, 200, w.Code, w.Body.String())
+		recs = nil
+		scanner = bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			var r downloadRecord
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &r))
+			recs = append(recs, r)
+		}
+		require.Len(t, recs, 4)
+		assert.Equal(t, recs[0].ClientIPv4, recs[1].ClientIPv4)
+		assert.NotEqual(t, recs[0].ClientIPv4, recs[2].ClientIPv4)
+		assert.NotContains(t, recs[0].ClientIPv4.String, "192.0.2")
+		assert.Len(t, recs[0].ClientIPv4.String, 16)
+	}
+
+	// The real addresses aren't given out with the stats API token, or when there's no export token set
+	assert.Equal(t, 403, get("/api/export?pseudonymise=false").Code)
+	assert.Equal(t, 401, getWith("wrong", "/api/export?pseudonymise=false").Code)
+	Conf.Stats.ExportToken = ""
+	liveConf.Store(newLiveSettings(Conf))
+	assert.Equal(t, 403, get("/api/export?pseudonymise=false").Code)
+	assert.Equal(t, 401, getWith("", "/api/export?pseudonymise=false").Code)
+	Conf.Stats.ExportToken = "export secret"
+	liveConf.Store(newLiveSettings(Conf))
+
+	// Parquet
+	w = get("/api/export?format=parquet&from=2024-10-01&to=2024-10-31&files=DB.Browser.*")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	assert.True(t, bytes.HasPrefix(w.Body.Bytes(), []byte("PAR1")))
+	pf, err := buffer.NewBufferFile(w.Body.Bytes())
+	require.NoError(t, err)
+	pr, err := reader.NewParquetColumnReader(pf, 1)
+	require.NoError(t, err)
+	defer pr.ReadStop()
+	assert.EqualValues(t, 9, pr.GetNumRows())
+	statuses, _, _, err := pr.ReadColumnByIndex(int64(column("status")), 9)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(200), int64(200), int64(404), int64(200), int64(200), int64(200), int64(206),
+		int64(206), int64(200)}, statuses)
+	ports, _, _, err := pr.ReadColumnByIndex(int64(column("client_port")), 9)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{nil, nil, nil, nil, nil, nil, nil, nil, nil}, ports)
+	classes, _, _, err := pr.ReadColumnByIndex(int64(column("ua_class")), 9)
+	require.NoError(t, err)
+	assert.Equal(t, "bot", classes[3])
+	rangeStarts, _, _, err := pr.ReadColumnByIndex(int64(column("range_start")), 9)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(0), int64(600), nil}, rangeStarts[6:])
+
+	// Nothing matching still gives a valid file
+	w = get("/api/export?format=parquet&from=2020-01-01&to=2020-01-31")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	pf, err = buffer.NewBufferFile(w.Body.Bytes())
+	require.NoError(t, err)
+	pr2, err := reader.NewParquetColumnReader(pf, 1)
+	require.NoError(t, err)
+	defer pr2.ReadStop()
+	assert.EqualValues(t, 0, pr2.GetNumRows())
+
+	// Bad options
+	assert.Equal(t, 400, get("/api/export?format=xml").Code)
+	assert.Equal(t, 400, get("/api/export?status=ok").Code)
+	assert.Equal(t, 400, get("/api/export?from=2024-10-31&to=2024-10-01").Code)
+	assert.Equal(t, 400, get("/api/export?pseudonymise=maybe").Code)
+}
+
+func TestGlobToLike(t *testing.T) {
+	assert.Equal(t, "%.dmg", globToLike("*.dmg"))
+	assert.Equal(t, "DB4S\\_3.13._.zip", globToLike("DB4S_3.13.?.zip"))
+	assert.Equal(t, "100\\%\\\\", globToLike("100%\\"))
+}
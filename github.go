@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// githubRelease is the part of a GitHub Releases API release we're interested in
+type githubRelease struct {
+	TagName string        `json:"tag_name"`
+	Assets  []githubAsset `json:"assets"`
+}
+type githubAsset struct {
+	Name          string `json:"name"`
+	DownloadCount int    `json:"download_count"`
+}
+
+// setGitHubDefaults fills in the GitHub collector settings not given in the config file
+func setGitHubDefaults(g *GitHubInfo) {
+	if g.APIURL == "" {
+		g.APIURL = "https://api.github.com"
+	}
+	if g.Repository == "" {
+		g.Repository = "sqlitebrowser/sqlitebrowser"
+	}
+}
+
+// githubCommand records a snapshot of the download counts of the GitHub release assets in the github_* tables
+func githubCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("collect-github", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "Only display the download counts, without saving them in PostgreSQL")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+
+	// Retrieve the download counts
+	ctx := context.Background()
+	client := &http.Client{Timeout: 30 * time.Second}
+	releases, err := fetchGitHubReleases(ctx, client, Conf.GitHub)
+	if err != nil {
+		return
+	}
+	counts := githubDownloadCounts(releases)
+	if *dryRun {
+		names := make([]string, 0, len(counts))
+		for name := range counts {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			fmt.Printf("%8d  %s\n", counts[name], name)
+		}
+		fmt.Printf("Retrieved download counts for %d assets from %d releases (dry run, nothing was saved)\n",
+			len(counts), len(releases))
+		return
+	}
+
+	// Save them
+	err = connectPostgreSQL()
+	if err == nil {
+		defer DB.Close()
+		err = DB.Ping(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't connect to PostgreSQL: %w", err)
+	}
+	newAssets, err := recordGitHubCounts(ctx, counts, time.Now())
+	if err != nil {
+		return
+	}
+	fmt.Printf("Recorded download counts for %d assets (%d new) from %d releases\n", len(counts), newAssets,
+		len(releases))
+	return
+}
+
+// fetchGitHubReleases retrieves the list of releases for the repository from the GitHub Releases API, following the
+// pagination links until all of them have been retrieved
+func fetchGitHubReleases(ctx context.Context, client *http.Client, conf GitHubInfo) (releases []githubRelease, err error) {
+	api, err := url.Parse(conf.APIURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GitHub API URL '%s': %w", conf.APIURL, err)
+	}
+	next := fmt.Sprintf("%s/repos/%s/releases?per_page=100", strings.TrimSuffix(conf.APIURL, "/"), conf.Repository)
+	for next != "" {
+		var page []githubRelease
+		page, next, err = fetchGitHubPage(ctx, client, next, conf.Token)
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, page...)
+
+		// The API token is sent with every page request, so next page links pointing anywhere other than the API
+		// server aren't followed
+		if next != "" && !sameOrigin(api, next) {
+			log.Printf("Ignoring GitHub next page link '%s', as it's not on the API server '%s'", next, conf.APIURL)
+			next = ""
+		}
+	}
+	return
+}
+
+// sameOrigin returns true if the given URL has the same scheme and host as the base one
+func sameOrigin(base *url.URL, link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, base.Scheme) && strings.EqualFold(u.Host, base.Host)
+}
+
+// fetchGitHubPage retrieves a single page of releases, returning the URL of the next page (if there is one)
+func fetchGitHubPage(ctx context.Context, client *http.Client, pageURL, token string) (page []githubRelease, next string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", "db4s_cluster_downloader")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, "", fmt.Errorf("GitHub API request '%s' failed: %s: %s", pageURL, resp.Status,
+			strings.TrimSpace(string(body)))
+	}
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	if err != nil {
+		return nil, "", fmt.Errorf("couldn't decode GitHub API response from '%s': %w", pageURL, err)
+	}
+
+	// The next page link is relative to the current page, though GitHub always gives a full URL
+	next = nextPageLink(resp.Header.Values("Link"))
+	if next != "" {
+		var base, u *url.URL
+		base, err = url.Parse(pageURL)
+		if err == nil {
+			u, err = base.Parse(next)
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid next page link '%s' from GitHub: %w", next, err)
+		}
+		next = u.String()
+	}
+	return
+}
+
+// nextPageLink returns the URL with rel="next" from the Link headers of a response.  eg:
+//
+//	Link: <https://api.github.com/repositories/1/releases?page=2>; rel="next", <...>; rel="last"
+func nextPageLink(headers []string) string {
+	for _, h := range headers {
+		for _, link := range strings.Split(h, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(key, "rel") && strings.Contains(" "+strings.Trim(value, `"`)+" ", " next ") {
+					return target[1 : len(target)-1]
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// githubDownloadCounts returns the download counts of the assets in a list of releases, keyed by asset name.  In the
+// unlikely case the same asset name is used in several releases, their counts are added together
+func githubDownloadCounts(releases []githubRelease) map[string]int {
+	counts := make(map[string]int)
+	for _, r := range releases {
+		for _, a := range r.Assets {
+			counts[a.Name] += a.DownloadCount
+		}
+	}
+	return counts
+}
+
+// recordGitHubCounts saves a snapshot of the GitHub download counts, adding any assets not seen before.  Returns the
+// number of new assets
+func recordGitHubCounts(ctx context.Context, counts map[string]int, at time.Time) (newAssets int, err error) {
+	err = pgx.BeginFunc(ctx, DB, func(tx pgx.Tx) (err error) {
+		var timestampID int
+		err = tx.QueryRow(ctx, `
+			INSERT INTO github_download_timestamps (count_timestamp)
+			VALUES ($1)
+			RETURNING timestamp_id`, at).Scan(&timestampID)
+		if err != nil {
+			return
+		}
+
+		// Add any new assets
+		var batch pgx.Batch
+		for name := range counts {
+			batch.Queue(`
+				INSERT INTO github_release_assets (asset_name)
+				VALUES ($1)
+				ON CONFLICT (asset_name) DO NOTHING`, name).Exec(func(tag pgconn.CommandTag) error {
+				newAssets += int(tag.RowsAffected())
+				return nil
+			})
+		}
+		err = tx.SendBatch(ctx, &batch).Close()
+		if err != nil {
+			return
+		}
+
+		// Record the counts
+		batch = pgx.Batch{}
+		for name, n := range counts {
+			batch.Queue(`
+				INSERT INTO github_download_counts (asset, download_count, count_timestamp)
+				SELECT asset_id, $2, $3
+				FROM github_release_assets
+				WHERE asset_name = $1`, name, n, timestampID)
+		}
+		return tx.SendBatch(ctx, &batch).Close()
+	})
+	return
+}
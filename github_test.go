@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchGitHubReleases(t *testing.T) {
+	// A fake GitHub API, returning the releases over two pages
+	pages := map[string]string{
+		"1": `[{"tag_name": "v3.13.1", "assets": [
+				{"name": "DB.Browser.for.SQLite-v3.13.1-win64.msi", "download_count": 1000},
+				{"name": "DB.Browser.for.SQLite-v3.13.1.dmg", "download_count": 500}]},
+			{"tag_name": "v3.13.0", "assets": [
+				{"name": "DB.Browser.for.SQLite-v3.13.0-win64.msi", "download_count": 2000}]}]`,
+		"2": `[{"tag_name": "v3.12.2", "assets": [
+				{"name": "DB.Browser.for.SQLite-3.12.2-win64.msi", "download_count": 3000}]},
+			{"tag_name": "continuous", "assets": [
+				{"name": "DB.Browser.for.SQLite-v3.13.1.dmg", "download_count": 7}]}]`,
+	}
+	var auth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/sqlitebrowser/sqlitebrowser/releases" {
+			http.NotFound(w, r)
+			return
+		}
+		auth = append(auth, r.Header.Get("Authorization"))
+		page := r.URL.Query().Get("page")
+		if page == "" {
+			page = "1"
+		}
+		if page == "1" {
+			// GitHub gives full URLs, but relative ones are handled too
+			w.Header().Add("Link", fmt.Sprintf(`<http://%s%s?per_page=100&page=2>; rel="next", `+
+				`<http://%s%s?per_page=100&page=2>; rel="last"`, r.Host, r.URL.Path, r.Host, r.URL.Path))
+		}
+		fmt.Fprint(w, pages[page])
+	}))
+	defer srv.Close()
+
+	conf := GitHubInfo{APIURL: srv.URL + "/", Token: "secret"}
+	setGitHubDefaults(&conf)
+	releases, err := fetchGitHubReleases(context.Background(), srv.Client(), conf)
+	require.NoError(t, err)
+	require.Len(t, releases, 4)
+	assert.Equal(t, "continuous", releases[3].TagName)
+	assert.Equal(t, []string{"Bearer secret", "Bearer secret"}, auth)
+	assert.Equal(t, map[string]int{
+		"DB.Browser.for.SQLite-v3.13.1-win64.msi": 1000,
+		"DB.Browser.for.SQLite-v3.13.1.dmg":       507,
+		"DB.Browser.for.SQLite-v3.13.0-win64.msi": 2000,
+		"DB.Browser.for.SQLite-3.12.2-win64.msi":  3000,
+	}, githubDownloadCounts(releases))
+
+	// Next page links to anywhere other than the API server aren't followed, so the token isn't sent elsewhere
+	var elsewhere []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		elsewhere = append(elsewhere, r.Header.Get("Authorization"))
+		fmt.Fprint(w, pages["2"])
+	}))
+	defer other.Close()
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Link", fmt.Sprintf(`<%s%s?per_page=100&page=2>; rel="next"`, other.URL, r.URL.Path))
+		fmt.Fprint(w, pages["1"])
+	}))
+	defer redirect.Close()
+	releases, err = fetchGitHubReleases(context.Background(), redirect.Client(),
+		GitHubInfo{APIURL: redirect.URL, Repository: conf.Repository, Token: "secret"})
+	require.NoError(t, err)
+	assert.Len(t, releases, 2)
+	assert.Empty(t, elsewhere)
+	assert.True(t, sameOrigin(&url.URL{Scheme: "https", Host: "api.github.com"}, "https://API.github.com/repos?page=2"))
+	assert.False(t, sameOrigin(&url.URL{Scheme: "https", Host: "api.github.com"}, "http://api.github.com/repos?page=2"))
+	assert.False(t, sameOrigin(&url.URL{Scheme: "https", Host: "api.github.com"}, "https://api.github.com:8443/repos"))
+
+	// Errors from the API are reported
+	conf.Repository = "sqlitebrowser/missing"
+	_, err = fetchGitHubReleases(context.Background(), srv.Client(), conf)
+	assert.ErrorContains(t, err, "404")
+
+	// Link header parsing
+	assert.Equal(t, "/releases?page=3", nextPageLink([]string{`</releases?page=1>; rel="prev", </releases?page=3>; rel="next"`}))
+	assert.Equal(t, "/releases?page=3", nextPageLink([]string{`</releases?page=1>; rel=first`, `</releases?page=3>; rel=next`}))
+	assert.Equal(t, "", nextPageLink([]string{`</releases?page=1>; rel="prev"`}))
+	assert.Equal(t, "", nextPageLink(nil))
+}
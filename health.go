@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+)
+
+// When the server started, for the liveness check
+var startTime = time.Now()
+
+// healthCheck is the result of one of the readiness checks
+type healthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+
+	// The underlying error of a failed check.  It can include file paths and database details, so is only shown to
+	// requests with the stats API token
+	err error
+}
+
+// healthzHandler is the liveness check.  If the server can answer at all, it's alive
+func healthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"uptime": time.Since(startTime).Round(time.Second).String(),
+	})
+}
+
+// readyzHandler is the readiness check, for load balancers to decide whether to send requests here.  The data
+// directory needs to be readable, every file in the release catalog needs to be there and verified, the index page
+// template needs to be loaded, and the database downloads are recorded in needs to answer.  The results of each check
+// are returned, with a 503 status if any of them failed.  This is public, so the errors behind failed checks are only
+// included for requests with the stats API token
+func readyzHandler(router *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cat := catalog.Load()
+		checks := map[string]healthCheck{
+			"data_dir": checkDataDir(cat),
+			"catalog":  checkCatalogFiles(cat),
+			"template": checkTemplate(router),
+			"database": checkDatabase(c.Request.Context()),
+		}
+		details := hasToken(c, liveConf.Load().apiToken)
+		status, code := "ready", http.StatusOK
+		for name, z := range checks {
+			if !z.OK {
+				status, code = "not ready", http.StatusServiceUnavailable
+				if details && z.err != nil {
+					z.Detail += ": " + z.err.Error()
+					checks[name] = z
+				}
+			}
+		}
+		c.JSON(code, gin.H{"status": status, "checks": checks})
+	}
+}
+
+// checkDataDir makes sure the directory the downloads are served from can be read
+func checkDataDir(cat *ReleaseCatalog) healthCheck {
+	d, err := os.Open(cat.paths.DataDir)
+	if err == nil {
+		_, err = d.ReadDir(1)
+		d.Close()
+	}
+	if err != nil {
+		return healthCheck{Detail: "the data directory can't be read", err: err}
+	}
+	return healthCheck{OK: true}
+}
+
+// checkCatalogFiles makes sure every file in the release catalog is in the data directory, and matches its checksum.
+// The checksums are cached by size and modification time, so they're only calculated for files which are new or have
+// changed since they were last verified
+func checkCatalogFiles(cat *ReleaseCatalog) healthCheck {
+	var (
+		problems []string
+		errs     []error
+	)
+	assets := cat.AllAssets()
+	for _, a := range assets {
+		info, err := os.Stat(filepath.Join(cat.paths.DataDir, a.Name))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s is missing", a.Name))
+			errs = append(errs, err)
+			continue
+		}
+		_, err = verifyAsset(cat, a, info)
+		switch {
+		case errors.Is(err, errChecksumMismatch):
+			problems = append(problems, fmt.Sprintf("%s doesn't match its checksum", a.Name))
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%s couldn't be verified", a.Name))
+			errs = append(errs, err)
+		}
+	}
+	if len(problems) > 0 {
+		return healthCheck{Detail: strings.Join(problems, ", "), err: errors.Join(errs...)}
+	}
+	return healthCheck{OK: true, Detail: fmt.Sprintf("%d files available", len(assets))}
+}
+
+// checkTemplate makes sure the index page template is loaded.  In debug mode it's loaded again for each request, so
+// it's only checked that it's there
+func checkTemplate(router *gin.Engine) healthCheck {
+	switch r := router.HTMLRender.(type) {
+	case render.HTMLProduction:
+		if r.Template != nil && r.Template.Lookup("downloads") != nil {
+			return healthCheck{OK: true}
+		}
+	case render.HTMLDebug:
+		// The template is always read from the base directory the server started with, as it's not reloadable
+		if _, err := os.Stat(filepath.Join(Conf.Paths.BaseDir, "template.html")); err != nil {
+			return healthCheck{Detail: "the index page template is missing", err: err}
+		}
+		return healthCheck{OK: true}
+	}
+	return healthCheck{Detail: "the index page template isn't loaded"}
+}
+
+// checkDatabase makes sure the database downloads are recorded in answers.  If downloads aren't being recorded at all
+// that's reported, but doesn't stop the files being served
+func checkDatabase(ctx context.Context) healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var err error
+	switch RecordDownloadsLocation {
+	case RECORD_IN_PG:
+		err = DB.Ping(ctx)
+	case RECORD_IN_SQLITE:
+		var n int
+		err = sdb.OneValue(`SELECT 1`, &n)
+	default:
+		return healthCheck{OK: true, Detail: "downloads aren't being recorded"}
+	}
+	if err != nil {
+		return healthCheck{Detail: recordLocationNames[RecordDownloadsLocation] + " isn't answering", err: err}
+	}
+	return healthCheck{OK: true, Detail: recordLocationNames[RecordDownloadsLocation]}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthChecks(t *testing.T) {
+	router := statsTestRouter(t)
+
+	// Serve a release catalog with a verified asset, and one without a checksum in the catalog
+	dir := t.TempDir()
+	asset := filepath.Join(dir, "good.msi")
+	require.NoError(t, os.WriteFile(asset, []byte("good"), 0644))
+	nightly := filepath.Join(dir, "nightly.dmg")
+	require.NoError(t, os.WriteFile(nightly, []byte("nightly"), 0644))
+	catFile := filepath.Join(dir, "releases.toml")
+	require.NoError(t, os.WriteFile(catFile, []byte(`[[release]]
+version = "1.0.0"
+
+  [[release.asset]]
+  name = "good.msi"
+  timestamp = 2024-10-16T07:48:52Z
+  sha256 = "770e607624d689265ca6c44884d0807d9b054d23c473c106c72be9de08b7376c"
+
+  [[release.asset]]
+  name = "nightly.dmg"
+  timestamp = 2024-10-16T07:48:52Z
+`), 0644))
+	c, err := loadCatalog(catFile, PathInfo{DataDir: dir})
+	require.NoError(t, err)
+	hashAssets(c)
+	catalog.Store(c)
+
+	type response struct {
+		Status string                 `json:"status"`
+		Checks map[string]healthCheck `json:"checks"`
+	}
+	getWith := func(token, url string) (code int, resp response) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		router.ServeHTTP(w, req)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return w.Code, resp
+	}
+	get := func(url string) (int, response) {
+		return getWith("", url)
+	}
+
+	code, resp := get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", resp.Status)
+
+	code, resp = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready", resp.Status)
+	assert.Equal(t, healthCheck{OK: true, Detail: "sqlite"}, resp.Checks["database"])
+	assert.True(t, resp.Checks["data_dir"].OK)
+	assert.True(t, resp.Checks["template"].OK)
+	assert.Equal(t, healthCheck{OK: true, Detail: "2 files available"}, resp.Checks["catalog"])
+
+	// Files which weren't verified at startup, or which have changed since, are verified when checked
+	checksumsMu.Lock()
+	delete(checksums, nightly)
+	checksumsMu.Unlock()
+	require.NoError(t, os.WriteFile(nightly, []byte("nightly build"), 0644))
+	code, resp = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthCheck{OK: true, Detail: "2 files available"}, resp.Checks["catalog"])
+
+	// A file no longer matching its checksum means the server isn't ready
+	require.NoError(t, os.WriteFile(asset, []byte("changed"), 0644))
+	code, resp = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "not ready", resp.Status)
+	assert.Equal(t, "good.msi doesn't match its checksum", resp.Checks["catalog"].Detail)
+
+	// As does one going missing.  The error behind it (including the path) is only given with the API token
+	require.NoError(t, os.Remove(asset))
+	_, resp = get("/readyz")
+	assert.Equal(t, "good.msi is missing", resp.Checks["catalog"].Detail)
+	_, resp = getWith("secret", "/readyz")
+	assert.Contains(t, resp.Checks["catalog"].Detail, "good.msi is missing: ")
+	assert.Contains(t, resp.Checks["catalog"].Detail, asset)
+	require.NoError(t, os.Rename(dir, dir+".moved"))
+	t.Cleanup(func() { os.Rename(dir+".moved", dir) })
+	_, resp = get("/readyz")
+	assert.Equal(t, healthCheck{Detail: "the data directory can't be read"}, resp.Checks["data_dir"])
+	_, resp = getWith("secret", "/readyz")
+	assert.Contains(t, resp.Checks["data_dir"].Detail, dir)
+	_, resp = getWith("wrong", "/readyz")
+	assert.NotContains(t, resp.Checks["data_dir"].Detail, dir)
+
+	// The health checks aren't recorded as downloads
+	stopDownloadLogger()
+	var n int
+	require.NoError(t, sdb.OneValue(`SELECT count(*) FROM download_log WHERE request IN ('/healthz', '/readyz')`, &n))
+	assert.Equal(t, 0, n)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	sqlite "github.com/gwenn/gosqlite"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// importSummary counts what happened to the downloads read from the SQLite database
+type importSummary struct {
+	read       int64
+	imported   int64
+	present    int64
+	unreadable int64
+}
+
+// importSQLiteCommand copies the downloads recorded in the local SQLite database (used while PostgreSQL wasn't
+// available) into the PostgreSQL download_log table.  Downloads already in PostgreSQL are skipped, so it's safe to run
+// this more than once on the same file
+func importSQLiteCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("import-sqlite", flag.ContinueOnError)
+	fileName := flags.String("file", sqliteDownloadsFile, "SQLite database to import the downloads from")
+	batchSize := flags.Int("batch", Conf.Logging.BatchSize, "Number of downloads to import at a time")
+	dryRun := flags.Bool("dry-run", false, "Only report what would be imported, without changing PostgreSQL")
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+	if *batchSize <= 0 {
+		return errors.New("the batch size needs to be at least 1")
+	}
+
+	// The SQLite database is opened read only, so it's left untouched
+	src, err := sqlite.Open(*fileName, sqlite.OpenReadOnly)
+	if err != nil {
+		return fmt.Errorf("couldn't open SQLite database '%s': %w", *fileName, err)
+	}
+	defer src.Close()
+	selectList, err := sqliteSelectList(src)
+	if err != nil {
+		return
+	}
+
+	// Connect to PostgreSQL
+	err = connectPostgreSQL()
+	if err == nil {
+		defer DB.Close()
+		err = DB.Ping(context.Background())
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't connect to PostgreSQL: %w", err)
+	}
+
+	// Import the downloads in batches
+	var sum importSummary
+	err = forEachSQLiteBatch(src, selectList, *batchSize, &sum, func(batch []downloadRecord) error {
+		err := importDownloads(context.Background(), batch, *dryRun, &sum)
+		if err != nil {
+			return fmt.Errorf("importing into PostgreSQL failed after %d downloads were imported: %w", sum.imported,
+				err)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// Display the summary
+	action := "imported into PostgreSQL"
+	if *dryRun {
+		action = "would be imported into PostgreSQL (dry run, nothing was changed)"
+	}
+	fmt.Printf("Read %d downloads from '%s'\n", sum.read, *fileName)
+	fmt.Printf("  %d %s\n", sum.imported, action)
+	fmt.Printf("  %d already in PostgreSQL, skipped\n", sum.present)
+	fmt.Printf("  %d unreadable, skipped\n", sum.unreadable)
+	return
+}
+
+// sqliteSelectList returns the list of columns to select from a SQLite download_log table, in the order used by
+// downloadRecord.scanSQLite().  Columns missing from databases created by older versions of this program are selected
+// as NULL
+func sqliteSelectList(conn *sqlite.Conn) (list string, err error) {
+	cols, err := conn.Columns("", "download_log")
+	if err != nil {
+		return
+	}
+	if len(cols) == 0 {
+		return "", errors.New("the SQLite database doesn't have a download_log table")
+	}
+	existing := make(map[string]bool)
+	for _, c := range cols {
+		existing[c.Name] = true
+	}
+	names := make([]string, 0, len(downloadColumns))
+	for _, c := range downloadColumns {
+		if existing[c] {
+			names = append(names, c)
+		} else {
+			names = append(names, "NULL AS "+c)
+		}
+	}
+	return strings.Join(names, ", "), nil
+}
+
+// forEachSQLiteBatch reads the downloads from a SQLite download_log table in batches, passing each batch to fn.  It
+// keeps going until the end of the table, even past batches where none of the rows could be read
+func forEachSQLiteBatch(conn *sqlite.Conn, selectList string, batchSize int, sum *importSummary, fn func([]downloadRecord) error) (err error) {
+	var lastID int64
+	for {
+		batch, nextID, err := readSQLiteDownloads(conn, selectList, lastID, batchSize, sum)
+		if err != nil || nextID == lastID {
+			return err
+		}
+		lastID = nextID
+		if len(batch) == 0 {
+			continue
+		}
+		err = fn(batch)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readSQLiteDownloads reads the next batch of downloads from a SQLite download_log table, starting after the given
+// download_id.  Rows which can't be understood are logged and counted, but otherwise skipped.  Downloads recorded
+// before event IDs were added are given one based on their contents, so they're only ever imported once
+func readSQLiteDownloads(conn *sqlite.Conn, selectList string, afterID int64, limit int, sum *importSummary) (recs []downloadRecord, lastID int64, err error) {
+	lastID = afterID
+	stmt, err := conn.Prepare(`SELECT download_id, ` + selectList + `
+		FROM download_log
+		WHERE download_id > ?
+		ORDER BY download_id
+		LIMIT ?`)
+	if err != nil {
+		return
+	}
+	defer stmt.Finalize()
+	err = stmt.Select(func(s *sqlite.Stmt) error {
+		id, _, err := s.ScanInt64(0)
+		if err != nil {
+			return err
+		}
+		lastID = id
+		sum.read++
+
+		var rec downloadRecord
+		err = rec.scanSQLite(s, 1)
+		if err != nil {
+			log.Printf("Skipping unreadable SQLite download_log row %d: %v", id, err)
+			sum.unreadable++
+			return nil
+		}
+		if !rec.EventID.Valid {
+			rec.EventID = legacyEventID(rec)
+		}
+		if !rec.AssetPackage.Valid {
+			rec.setAsset()
+		}
+		if !rec.UAClass.Valid {
+			rec.setUserAgentClass(userAgentRules.Load())
+		}
+		recs = append(recs, rec)
+		return nil
+	}, afterID, limit)
+	return
+}
+
+// legacyEventFields are the download details the event IDs of downloads recorded before event IDs were added are
+// derived from.  These are the fields downloadRecord had at the time, with the same names and order, so the IDs stay
+// the same however downloadRecord changes.  The event ID itself is always empty, but was included back then
+type legacyEventFields struct {
+	ClientIPv4      pgtype.Text `json:"client_ipv4"`
+	ClientIPv6      pgtype.Text `json:"client_ipv6"`
+	ClientIPStrange pgtype.Text `json:"client_ip_strange"`
+	ClientPort      pgtype.Int4 `json:"client_port"`
+	RemoteUser      pgtype.Text `json:"remote_user"`
+	RequestTime     time.Time   `json:"request_time"`
+	RequestType     string      `json:"request_type"`
+	Request         string      `json:"request"`
+	Protocol        string      `json:"protocol"`
+	Status          int         `json:"status"`
+	BodyBytesSent   int         `json:"body_bytes_sent"`
+	HTTPReferer     pgtype.Text `json:"http_referer"`
+	HTTPUserAgent   string      `json:"http_user_agent"`
+	EventID         pgtype.Text `json:"event_id"`
+}
+
+// legacyEventID returns an event ID for a download recorded before event IDs were added.  It's derived from the
+// download details, so the same download is always given the same ID
+func legacyEventID(rec downloadRecord) pgtype.Text {
+	data, _ := json.Marshal(legacyEventFields{
+		ClientIPv4:      rec.ClientIPv4,
+		ClientIPv6:      rec.ClientIPv6,
+		ClientIPStrange: rec.ClientIPStrange,
+		ClientPort:      rec.ClientPort,
+		RemoteUser:      rec.RemoteUser,
+		RequestTime:     rec.RequestTime,
+		RequestType:     rec.RequestType,
+		Request:         rec.Request,
+		Protocol:        rec.Protocol,
+		Status:          rec.Status,
+		BodyBytesSent:   rec.BodyBytesSent,
+		HTTPReferer:     rec.HTTPReferer,
+		HTTPUserAgent:   rec.HTTPUserAgent,
+	})
+	h := sha256.Sum256(data)
+	return pgtype.Text{String: hex.EncodeToString(h[:16]), Valid: true}
+}
+
+// importDownloads inserts the downloads not already in PostgreSQL.  For a dry run, they're only counted
+func importDownloads(ctx context.Context, batch []downloadRecord, dryRun bool, sum *importSummary) (err error) {
+	ids := make([]string, 0, len(batch))
+	for _, rec := range batch {
+		ids = append(ids, rec.EventID.String)
+	}
+	rows, err := DB.Query(ctx, `SELECT event_id FROM download_log WHERE event_id = ANY($1)`, ids)
+	if err != nil {
+		return
+	}
+	present, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return
+	}
+	existing := make(map[string]bool, len(present))
+	for _, id := range present {
+		existing[id] = true
+	}
+	newRecs := make([]downloadRecord, 0, len(batch))
+	for _, rec := range batch {
+		if existing[rec.EventID.String] {
+			sum.present++
+			continue
+		}
+		newRecs = append(newRecs, rec)
+	}
+	if dryRun {
+		sum.imported += int64(len(newRecs))
+		return
+	}
+
+	// Anything inserted by someone else since the check above is still skipped, thanks to the unique event ID
+	duplicates, err := insertNewDownloads(ctx, newRecs)
+	if err != nil {
+		return
+	}
+	sum.present += duplicates
+	sum.imported += int64(len(newRecs)) - duplicates
+	return
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	sqlite "github.com/gwenn/gosqlite"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSQLiteDownloads(t *testing.T) {
+	oldSdb, oldLocation := sdb, RecordDownloadsLocation
+	t.Cleanup(func() {
+		sdb, RecordDownloadsLocation = oldSdb, oldLocation
+	})
+
+	// Record some downloads using the current table layout
+	dir := t.TempDir()
+	require.NoError(t, connectSQLite(filepath.Join(dir, "current.sqlite")))
+	recs := []downloadRecord{
+		{
+			ClientIPv4:    pgtype.Text{String: "192.0.2.1", Valid: true},
+			ClientPort:    pgtype.Int4{Int32: 40000, Valid: true},
+			RequestTime:   time.Date(2024, 10, 16, 7, 48, 52, 123456789, time.UTC),
+			RequestType:   "GET",
+			Request:       "/DB.Browser.for.SQLite-v3.13.1-win64.msi",
+			Protocol:      "HTTP/1.1",
+			Status:        200,
+			BodyBytesSent: 1234,
+			HTTPReferer:   pgtype.Text{String: "https://sqlitebrowser.org/dl/", Valid: true},
+			HTTPUserAgent: "test",
+			EventID:       pgtype.Text{String: "0123456789abcdef0123456789abcdef", Valid: true},
+		},
+		{
+			ClientIPv6:    pgtype.Text{String: "2001:db8::1", Valid: true},
+			RequestTime:   time.Date(2024, 10, 16, 7, 48, 53, 0, time.UTC),
+			RequestType:   "GET",
+			Request:       "/DB.Browser.for.SQLite-v3.13.1.dmg",
+			Protocol:      "HTTP/2.0",
+			Status:        404,
+			HTTPUserAgent: "test",
+			EventID:       pgtype.Text{String: "fedcba9876543210fedcba9876543210", Valid: true},
+		},
+	}
+	for i := range recs {
+		recs[i].setAsset()
+	}
+	RecordDownloadsLocation = RECORD_IN_SQLITE
+	writeDownloads(recs)
+	sdb.Close()
+
+	// Everything should be read back the same, in batches
+	conn, err := sqlite.Open(filepath.Join(dir, "current.sqlite"), sqlite.OpenReadOnly)
+	require.NoError(t, err)
+	defer conn.Close()
+	selectList, err := sqliteSelectList(conn)
+	require.NoError(t, err)
+	var sum importSummary
+	batch, lastID, err := readSQLiteDownloads(conn, selectList, 0, 1, &sum)
+	require.NoError(t, err)
+	assert.Equal(t, recs[:1], batch)
+	batch, lastID, err = readSQLiteDownloads(conn, selectList, lastID, 1, &sum)
+	require.NoError(t, err)
+	assert.Equal(t, recs[1:], batch)
+	batch, _, err = readSQLiteDownloads(conn, selectList, lastID, 1, &sum)
+	require.NoError(t, err)
+	assert.Empty(t, batch)
+	assert.Equal(t, importSummary{read: 2}, sum)
+
+	// Databases created before event IDs were added should have them generated instead, the same each time
+	old, err := sqlite.Open(filepath.Join(dir, "old.sqlite"), sqlite.OpenReadWrite|sqlite.OpenCreate)
+	require.NoError(t, err)
+	defer old.Close()
+	require.NoError(t, old.Exec(`
+		CREATE TABLE download_log (
+			download_id INTEGER PRIMARY KEY, remote_user text, request_time timestamp with time zone,
+			request_type text, request text, protocol text, status integer, body_bytes_sent bigint,
+			http_referer text, http_user_agent text, client_ipv4 text, client_ipv6 text, client_ip_strange text,
+			client_port integer)`))
+	require.NoError(t, old.Exec(`
+		INSERT INTO download_log (request_time, request_type, request, protocol, status, body_bytes_sent,
+			http_user_agent, client_ipv4, client_port)
+		VALUES ('2021-01-02T03:04:05.123Z', 'GET', '/currentrelease', 'HTTP/1.1', 200, 30, 'old', '192.0.2.2', 1234),
+			('2021-01-02T03:04:06.456Z', 'GET', '/currentrelease', 'HTTP/1.1', 200, 30, 'old', '192.0.2.2', 1234),
+			('not a time', 'GET', '/currentrelease', 'HTTP/1.1', 200, 30, 'old', '192.0.2.2', 1234)`))
+	selectList, err = sqliteSelectList(old)
+	require.NoError(t, err)
+	sum = importSummary{}
+	batch, _, err = readSQLiteDownloads(old, selectList, 0, 10, &sum)
+	require.NoError(t, err)
+	require.Len(t, batch, 2)
+	assert.Equal(t, importSummary{read: 3, unreadable: 1}, sum)
+	assert.True(t, batch[0].EventID.Valid)
+	assert.Len(t, batch[0].EventID.String, 32)
+	assert.NotEqual(t, batch[0].EventID, batch[1].EventID)
+	again, _, err := readSQLiteDownloads(old, selectList, 0, 10, &importSummary{})
+	require.NoError(t, err)
+	assert.Equal(t, batch, again)
+	assert.Equal(t, "0271778c3012de6073878fa9c1a2000c", batch[0].EventID.String) // As given by earlier imports
+
+	// A batch where none of the rows could be read doesn't stop the rest being imported
+	require.NoError(t, old.Exec(`
+		INSERT INTO download_log (request_time, request_type, request, protocol, status, body_bytes_sent,
+			http_user_agent, client_ipv4, client_port)
+		VALUES ('2021-01-02T03:04:07.789Z', 'GET', '/currentrelease', 'HTTP/1.1', 200, 30, 'old', '192.0.2.3', 1234)`))
+	sum = importSummary{}
+	var imported []downloadRecord
+	err = forEachSQLiteBatch(old, selectList, 1, &sum, func(batch []downloadRecord) error {
+		imported = append(imported, batch...)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, imported, 3)
+	assert.Equal(t, "192.0.2.3", imported[2].ClientIPv4.String)
+	assert.Equal(t, importSummary{read: 4, unreadable: 1}, sum)
+
+	// Fields added since event IDs were introduced don't change the generated IDs
+	rec := batch[0]
+	rec.Request = "/DB.Browser.for.SQLite-v3.13.1-win64.msi"
+	withoutAsset := legacyEventID(rec)
+	rec.setAsset()
+	assert.Equal(t, withoutAsset, legacyEventID(rec))
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	// Serialises access to the download journal files
+	journalMu sync.Mutex
+)
+
+// appendJournal saves download records to the local journal file, one JSON object per line.  These are replayed into
+// PostgreSQL by replayJournal() once it's reachable again
+func appendJournal(batch []downloadRecord) {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+
+	f, err := os.OpenFile(Conf.Logging.Journal, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("Couldn't open download journal '%s', %d download records have been lost: %v", Conf.Logging.Journal,
+			len(batch), err)
+		return
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for i := range batch {
+		if err = enc.Encode(&batch[i]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		// Make sure the records are on disk before we forget about them
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		log.Printf("Error when writing %d download records to journal '%s': %v", len(batch), Conf.Logging.Journal, err)
+	}
+}
+
+// journalReplayer periodically checks for download records saved in the journal, and replays them into PostgreSQL
+// when it's reachable again
+func journalReplayer() {
+	ticker := time.NewTicker(time.Duration(Conf.Logging.ReplayInterval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if RecordDownloadsLocation != RECORD_IN_PG || !journalWaiting() {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := DB.Ping(ctx)
+		cancel()
+		if err != nil {
+			if debug.Load() {
+				log.Printf("PostgreSQL still unavailable, not replaying the download journal yet: %v", err)
+			}
+			continue
+		}
+		err = replayJournal(context.Background())
+		if err != nil {
+			log.Printf("Replaying the download journal failed, will try again later: %v", err)
+		}
+	}
+}
+
+// journalWaiting returns true if there are download records in the journal waiting to be replayed
+func journalWaiting() bool {
+	for _, f := range []string{Conf.Logging.Journal + ".replay", Conf.Logging.Journal} {
+		if info, err := os.Stat(f); err == nil && info.Size() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// replayJournal inserts the download records from the journal into PostgreSQL.  Records already in PostgreSQL (going by
+// their event ID) are skipped, so replaying the same journal more than once doesn't create duplicates.  Entries which
+// can't be replayed (damaged lines, or records PostgreSQL refuses) are moved to the dead letter file next to the
+// journal, so they don't hold up the rest
+func replayJournal(ctx context.Context) (err error) {
+	// Move the journal out of the way first, so new records can keep being added while this one is replayed.  If
+	// there's a journal left over from a previous (failed) replay, that's done first
+	replayFile := Conf.Logging.Journal + ".replay"
+	journalMu.Lock()
+	if _, err = os.Stat(replayFile); errors.Is(err, os.ErrNotExist) {
+		err = os.Rename(Conf.Logging.Journal, replayFile)
+	}
+	journalMu.Unlock()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// Nothing to replay
+			return nil
+		}
+		return
+	}
+
+	f, err := os.Open(replayFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	dead := &deadLetterFile{name: Conf.Logging.Journal + ".failed"}
+	total, duplicates, failed, err := replayRecords(ctx, f, insertNewDownloads, dead)
+	if err2 := dead.close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return
+	}
+
+	// Everything has been replayed, so the journal isn't needed any more
+	f.Close()
+	err = os.Remove(replayFile)
+	log.Printf("Replayed %d download records from the journal into PostgreSQL (%d were already present)", total,
+		duplicates)
+	if failed > 0 {
+		log.Printf("%d download journal entries couldn't be replayed, and were moved to '%s'", failed, dead.name)
+	}
+	return
+}
+
+// replayRecords reads the download records from a journal, and inserts them in batches using insert.  Damaged entries,
+// and records PostgreSQL refuses, are written to the dead letter file instead.  Any other error (eg losing the
+// connection to PostgreSQL) stops the replay, so it can be tried again later.  Entries can end up in the dead letter
+// file more than once that way, but the records keep their event IDs so they're still only ever inserted once
+func replayRecords(ctx context.Context, r io.Reader, insert func(context.Context, []downloadRecord) (int64, error),
+	dead *deadLetterFile) (total, duplicates, failed int64, err error) {
+	var batch []downloadRecord
+	send := func() (err error) {
+		n, err := insert(ctx, batch)
+		if isRejectedRecord(err) {
+			// One of the records was refused, and the batch is rolled back as a whole, so insert them one at a time
+			// to find which
+			n, err = 0, nil
+			for i := range batch {
+				d, err := insert(ctx, batch[i:i+1])
+				if isRejectedRecord(err) {
+					log.Printf("PostgreSQL refused download journal record '%s': %v", batch[i].EventID.String, err)
+					failed++
+					err = dead.writeRecord(&batch[i])
+				}
+				if err != nil {
+					return err
+				}
+				n += d
+			}
+		}
+		duplicates += n
+		batch = batch[:0]
+		return
+	}
+	br := bufio.NewReaderSize(r, 64*1024)
+	for {
+		line, skipped, err2 := readJournalLine(br, dead)
+		if skipped {
+			log.Printf("Skipping download journal entry longer than %d bytes", maxJournalLine)
+			failed++
+		}
+		if errors.Is(err2, io.EOF) {
+			break
+		}
+		if err2 != nil {
+			return total, duplicates, failed, err2
+		}
+		if skipped || len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var rec downloadRecord
+		if err = json.Unmarshal(line, &rec); err != nil {
+			// Most likely a partially written line from a crash
+			log.Printf("Skipping damaged download journal entry: %v", err)
+			failed++
+			if !bytes.HasSuffix(line, []byte("\n")) {
+				line = append(line, '\n')
+			}
+			if err = dead.write(line); err != nil {
+				return
+			}
+			continue
+		}
+		if !rec.AssetPackage.Valid {
+			// Written before the asset details were added
+			rec.setAsset()
+		}
+		if !rec.UAClass.Valid {
+			rec.setUserAgentClass(userAgentRules.Load())
+		}
+		batch = append(batch, rec)
+		total++
+		if len(batch) >= Conf.Logging.BatchSize {
+			if err = send(); err != nil {
+				return
+			}
+		}
+	}
+	err = send()
+	return
+}
+
+// Download journal entries are well under this length, so anything longer is damage (eg line endings lost in a crash)
+const maxJournalLine = 1024 * 1024
+
+// readJournalLine reads the next line of a journal, including its line ending.  Lines longer than maxJournalLine are
+// copied straight to the dead letter file rather than being read into memory, with skipped set instead.  Returns io.EOF
+// once there's nothing left
+func readJournalLine(r *bufio.Reader, dead *deadLetterFile) (line []byte, skipped bool, err error) {
+	var chunk []byte
+	for {
+		chunk, err = r.ReadSlice('\n')
+		if !skipped && len(line)+len(chunk) > maxJournalLine {
+			skipped = true
+			if err2 := dead.write(line); err2 != nil {
+				return nil, true, err2
+			}
+			line = nil
+		}
+		if skipped {
+			if err2 := dead.write(chunk); err2 != nil {
+				return nil, true, err2
+			}
+		} else {
+			line = append(line, chunk...)
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			break
+		}
+	}
+	if skipped && !bytes.HasSuffix(chunk, []byte("\n")) {
+		if err2 := dead.write([]byte("\n")); err2 != nil {
+			return nil, true, err2
+		}
+	}
+	if errors.Is(err, io.EOF) && (len(line) > 0 || skipped) {
+		// The last line doesn't have a line ending
+		err = nil
+	}
+	return
+}
+
+// isRejectedRecord returns true if the error is PostgreSQL refusing the data in a record, rather than a problem which
+// could go away by itself (eg the connection being lost)
+func isRejectedRecord(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	// Data exceptions (eg invalid text encoding) and integrity constraint violations
+	class := pgErr.Code[:min(2, len(pgErr.Code))]
+	return class == "22" || class == "23"
+}
+
+// deadLetterFile collects the download journal entries which couldn't be replayed, one per line, so they can be looked
+// at later.  The file is only created if there's something to put in it
+type deadLetterFile struct {
+	name string
+	f    *os.File
+}
+
+// write adds data to the dead letter file
+func (d *deadLetterFile) write(data []byte) (err error) {
+	if d.f == nil {
+		d.f, err = os.OpenFile(d.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return
+		}
+	}
+	_, err = d.f.Write(data)
+	return
+}
+
+// writeRecord adds a download record to the dead letter file, in the same format as the journal
+func (d *deadLetterFile) writeRecord(rec *downloadRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return d.write(append(b, '\n'))
+}
+
+// close makes sure everything written to the dead letter file is on disk, then closes it
+func (d *deadLetterFile) close() (err error) {
+	if d.f == nil {
+		return
+	}
+	err = d.f.Sync()
+	if err2 := d.f.Close(); err == nil {
+		err = err2
+	}
+	d.f = nil
+	return
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournalRoundTrip(t *testing.T) {
+	oldJournal := Conf.Logging.Journal
+	t.Cleanup(func() { Conf.Logging.Journal = oldJournal })
+	Conf.Logging.Journal = filepath.Join(t.TempDir(), "journal.jsonl")
+
+	recs := []downloadRecord{
+		{
+			ClientIPv4:    pgtype.Text{String: "192.0.2.1", Valid: true},
+			ClientPort:    pgtype.Int4{Int32: 54321, Valid: true},
+			RequestTime:   time.Date(2024, time.October, 16, 7, 48, 52, 123456789, time.UTC),
+			RequestType:   "GET",
+			Request:       "/DB.Browser.for.SQLite-v3.13.1.dmg",
+			Protocol:      "HTTP/2.0",
+			Status:        200,
+			BodyBytesSent: 12345678,
+			HTTPReferer:   pgtype.Text{String: "https://sqlitebrowser.org/dl/", Valid: true},
+			HTTPUserAgent: "Mozilla/5.0",
+			EventID:       newEventID(),
+		},
+		{
+			ClientIPv6:    pgtype.Text{String: "2001:db8::1", Valid: true},
+			RequestTime:   time.Date(2024, time.October, 16, 7, 49, 0, 0, time.UTC),
+			RequestType:   "HEAD",
+			Request:       "/currentrelease",
+			Protocol:      "HTTP/1.1",
+			Status:        200,
+			BodyBytesSent: -1,
+			EventID:       newEventID(),
+		},
+	}
+	assert.NotEqual(t, recs[0].EventID, recs[1].EventID)
+
+	// Appending twice should add to the journal, not replace it
+	appendJournal(recs[:1])
+	appendJournal(recs[1:])
+	assert.True(t, journalWaiting())
+
+	f, err := os.Open(Conf.Logging.Journal)
+	require.NoError(t, err)
+	defer f.Close()
+	var got []downloadRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec downloadRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &rec))
+		got = append(got, rec)
+	}
+	require.Len(t, got, 2)
+	for i := range recs {
+		assert.True(t, recs[i].RequestTime.Equal(got[i].RequestTime))
+		got[i].RequestTime = recs[i].RequestTime
+		assert.Equal(t, recs[i], got[i])
+	}
+}
+
+func TestReplayPoisonedJournal(t *testing.T) {
+	oldBatchSize := Conf.Logging.BatchSize
+	t.Cleanup(func() { Conf.Logging.BatchSize = oldBatchSize })
+	Conf.Logging.BatchSize = 3
+
+	// A journal with a damaged line, a line far too long to be a record, and a record PostgreSQL refuses (text can't
+	// contain NUL characters), amongst good records
+	var journal bytes.Buffer
+	enc := json.NewEncoder(&journal)
+	rec := func(request string) {
+		require.NoError(t, enc.Encode(downloadRecord{RequestTime: time.Now(), RequestType: "GET", Request: request,
+			Status: 200, EventID: newEventID()}))
+	}
+	rec("/one")
+	journal.WriteString("{\"request\": \"/dama\n")
+	rec("/two")
+	rec("/poisoned\x00")
+	journal.WriteString(strings.Repeat("x", maxJournalLine+10) + "\n")
+	rec("/three")
+	rec("/four")
+	journal.WriteString(`{"request": "/partial`)
+
+	// A fake PostgreSQL, refusing any batch with the poisoned record in it
+	var inserted []string
+	insert := func(_ context.Context, recs []downloadRecord) (int64, error) {
+		for _, r := range recs {
+			if strings.Contains(r.Request, "\x00") {
+				return 0, &pgconn.PgError{Code: "22021", Message: "invalid byte sequence for encoding \"UTF8\": 0x00"}
+			}
+		}
+		for _, r := range recs {
+			inserted = append(inserted, r.Request)
+		}
+		return 0, nil
+	}
+	dead := &deadLetterFile{name: filepath.Join(t.TempDir(), "journal.jsonl.failed")}
+	total, _, failed, err := replayRecords(context.Background(), bytes.NewReader(journal.Bytes()), insert, dead)
+	require.NoError(t, err)
+	require.NoError(t, dead.close())
+	assert.EqualValues(t, 5, total)
+	assert.EqualValues(t, 4, failed)
+	assert.Equal(t, []string{"/one", "/two", "/three", "/four"}, inserted)
+
+	// Everything which couldn't be replayed is in the dead letter file, one entry per line
+	b, err := os.ReadFile(dead.name)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	require.Len(t, lines, 4)
+	assert.Equal(t, `{"request": "/dama`, lines[0])
+	var poisoned downloadRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &poisoned))
+	assert.Equal(t, "/poisoned\x00", poisoned.Request)
+	assert.Len(t, lines[2], maxJournalLine+10)
+	assert.Equal(t, `{"request": "/partial`, lines[3])
+
+	// Anything else stops the replay, so it can be tried again later
+	dead = &deadLetterFile{name: filepath.Join(t.TempDir(), "journal.jsonl.failed")}
+	_, _, _, err = replayRecords(context.Background(), bytes.NewReader(journal.Bytes()),
+		func(context.Context, []downloadRecord) (int64, error) { return 0, errors.New("connection refused") }, dead)
+	assert.ErrorContains(t, err, "connection refused")
+	require.NoError(t, dead.close())
+	b, err = os.ReadFile(dead.name)
+	require.NoError(t, err)
+	assert.Equal(t, 1, bytes.Count(b, []byte("\n")))
+}
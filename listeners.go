@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Paths always served over plain HTTP, even when it's redirecting to HTTPS, so load balancers can check on us
+var alwaysHTTPPaths = []string{"/healthz", "/readyz"}
+
+// newServer creates an HTTP server listening on the given port.  There's no write timeout here, as the downloads can
+// take much longer than any sensible limit over slow connections.  Instead, each response gets its own write deadline,
+// which the file transfers keep extending while data is still moving
+func newServer(port int, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		ErrorLog:          HttpErrorLog(),
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+}
+
+// startServers starts the download servers.  When a TLS certificate is configured (or comes from ACME), HTTPS is served
+// on the SSL port and plain HTTP on the normal port (if one is set), with plain HTTP either redirecting to HTTPS or
+// serving the same as it, depending on the "http" server setting.  Without a certificate, only plain HTTP is served.
+// Errors from the servers are sent to the returned channel when they stop
+func startServers(router http.Handler) (servers []*http.Server, errs chan error, err error) {
+	var m *autocert.Manager
+	if len(Conf.ACME.Domains) > 0 {
+		m, err = newACMEManager(Conf.ACME)
+		if err != nil {
+			return
+		}
+		log.Printf("Using ACME certificates from '%s' for %s", Conf.ACME.DirectoryURL,
+			strings.Join(Conf.ACME.Domains, ", "))
+	}
+	useTLS := m != nil || (Conf.TLS.CertFile != "" && Conf.TLS.KeyFile != "")
+	if useTLS && m == nil {
+		// Certificates from files are reloaded when the files change, so renewals don't need a restart
+		var cert *tls.Certificate
+		cert, err = loadCertificate(Conf.TLS.CertFile, Conf.TLS.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't load the TLS certificate '%s': %w", Conf.TLS.CertFile, err)
+		}
+		tlsCert.Store(cert)
+		go watchCertificate(Conf.TLS.CertFile, Conf.TLS.KeyFile)
+	}
+	errs = make(chan error, 2)
+	if useTLS {
+		s := newServer(Conf.Server.SSLPort, router)
+		s.TLSConfig = serverTLSConfig(m)
+		log.Printf("Listening for HTTPS on port %d...", Conf.Server.SSLPort)
+		go func() {
+			// The certificates come from the TLS config, rather than being loaded once here
+			errs <- s.ListenAndServeTLS("", "")
+		}()
+		servers = append(servers, s)
+	}
+	if !useTLS || Conf.Server.Port > 0 {
+		h := router
+		if useTLS && Conf.Server.HTTP == "redirect" {
+			h = httpsRedirect(router, Conf.Server)
+		}
+		if m != nil {
+			// Answer the ACME HTTP-01 challenges, passing everything else through
+			h = m.HTTPHandler(h)
+		}
+		s := newServer(Conf.Server.Port, h)
+		log.Printf("Listening for HTTP on port %d...", Conf.Server.Port)
+		go func() {
+			errs <- s.ListenAndServe()
+		}()
+		servers = append(servers, s)
+	}
+	return
+}
+
+// serverTLSConfig returns the TLS settings for the HTTPS server.  With ACME, the certificates come from the ACME
+// manager, which also answers the TLS-ALPN-01 challenges.  Otherwise it's the certificate loaded from the configured
+// files, as swapped in by watchCertificate
+func serverTLSConfig(m *autocert.Manager) *tls.Config {
+	cfg := &tls.Config{GetCertificate: getCertificate}
+	if m != nil {
+		cfg = m.TLSConfig()
+	}
+	cfg.MinVersion = tls.VersionTLS12 // TLS 1.2 is now the lowest acceptable level
+	return cfg
+}
+
+// waitForServers waits until one of the servers stops.  An error other than it being shut down is fatal
+func waitForServers(errs chan error) {
+	err := <-errs
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+// httpsRedirect redirects plain HTTP requests to the same location over HTTPS, apart from the paths listed in the
+// http_paths server setting (eg "/currentrelease", for old DB4S versions which don't use HTTPS), which are passed
+// through to the router instead
+func httpsRedirect(router http.Handler, s ServerInfo) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(s.HTTPPaths, r.URL.Path) || slices.Contains(alwaysHTTPPaths, r.URL.Path) {
+			router.ServeHTTP(w, r)
+			return
+		}
+		code := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			code = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, httpsURL(r, s.RedirectPort), code)
+	})
+}
+
+// httpsURL returns the HTTPS location of a request, keeping the host name, path, and query string
+func httpsURL(r *http.Request, port int) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		// An IPv6 address without a port number.  The brackets are added back below
+		host = host[1 : len(host)-1]
+	}
+	if port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(port))
+	} else if net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+		// Bare IPv6 addresses still need their brackets
+		host = "[" + host + "]"
+	}
+	return "https://" + host + r.URL.RequestURI()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	router := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("served " + r.URL.Path))
+	})
+	h := httpsRedirect(router, ServerInfo{HTTPPaths: []string{"/currentrelease"}, RedirectPort: 443})
+	get := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		return w
+	}
+
+	// Redirects keep the host, path, and query string
+	w := get("GET", "http://download.sqlitebrowser.org/DB.Browser.for.SQLite-v3.13.1-win64.msi?x=1")
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "https://download.sqlitebrowser.org/DB.Browser.for.SQLite-v3.13.1-win64.msi?x=1",
+		w.Header().Get("Location"))
+	w = get("POST", "http://download.sqlitebrowser.org:9080/")
+	assert.Equal(t, http.StatusPermanentRedirect, w.Code)
+	assert.Equal(t, "https://download.sqlitebrowser.org/", w.Header().Get("Location"))
+
+	// The exempt paths, and the health checks, are served directly
+	w = get("GET", "http://download.sqlitebrowser.org/currentrelease")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "served /currentrelease", w.Body.String())
+	w = get("GET", "http://download.sqlitebrowser.org/readyz")
+	assert.Equal(t, "served /readyz", w.Body.String())
+
+	// Other ports are included in the redirect
+	h = httpsRedirect(router, ServerInfo{RedirectPort: 9443})
+	w = get("GET", "http://[2001:db8::1]:9080/currentrelease")
+	assert.Equal(t, "https://[2001:db8::1]:9443/currentrelease", w.Header().Get("Location"))
+}
+
+func TestHTTPSURL(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://[2001:db8::1]/a?b=c", nil)
+	assert.Equal(t, "https://[2001:db8::1]/a?b=c", httpsURL(r, 443))
+	assert.Equal(t, "https://[2001:db8::1]:8443/a?b=c", httpsURL(r, 8443))
+	r = httptest.NewRequest("GET", "http://[::1]/", nil)
+	assert.Equal(t, "https://[::1]:8443/", httpsURL(r, 8443))
+	assert.Equal(t, "https://[::1]/", httpsURL(r, 443))
+	r = httptest.NewRequest("GET", "http://[::1]:9080/", nil)
+	assert.Equal(t, "https://[::1]:8443/", httpsURL(r, 8443))
+	r = httptest.NewRequest("GET", "http://192.0.2.1:9080/", nil)
+	assert.Equal(t, "https://192.0.2.1/", httpsURL(r, 443))
+	assert.Equal(t, "https://192.0.2.1:9443/", httpsURL(r, 9443))
+}
@@ -4,13 +4,16 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"html/template"
 	"log"
-	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -25,8 +28,11 @@ var (
 	// Conf holds the application configuration values
 	Conf TomlConfig
 
-	// Should debugging info be displayed?
-	debug bool
+	// Location of the configuration file
+	configFile string
+
+	// Should debugging info be displayed?  Atomic, as it's changed when the configuration file is reloaded
+	debug atomic.Bool
 
 	// PostgreSQL Connection pool
 	DB *pgpool.Pool
@@ -34,76 +40,16 @@ var (
 	// SQLite connection, used as fallback if PostgreSQL isn't available
 	sdb *sqlite.Conn
 
-	// Timestamps for the files.  Up until the 3.13.0 release we use hard coded values that match GitHub, but don't
-	// bother any more as that's probably not important
-	timeStamps = map[string]time.Time{
-		// SHA256 checksums
-		"SHA256SUMS.txt": time.Date(2024, time.October, 16, 07, 48, 52, 0, time.UTC),
-
-		// *** 3.10.1 release ***
-		"DB.Browser.for.SQLite-3.10.1-win32.exe":               time.Date(2017, time.September, 20, 14, 59, 44, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.10.1-win64.exe":               time.Date(2017, time.September, 20, 14, 59, 59, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.10.1.dmg":                     time.Date(2017, time.September, 20, 15, 23, 27, 0, time.UTC),
-		"SQLiteDatabaseBrowserPortable_3.10.1_English.paf.exe": time.Date(2017, time.September, 28, 19, 32, 48, 0, time.UTC),
-
-		// *** 3.11.0 release ***
-		"DB.Browser.for.SQLite-3.11.0-win32.msi": time.Date(2019, time.February, 5, 17, 33, 47, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.11.0-win32.zip": time.Date(2019, time.February, 5, 17, 34, 1, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.11.0-win64.msi": time.Date(2019, time.February, 5, 17, 34, 21, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.11.0-win64.zip": time.Date(2019, time.February, 5, 17, 34, 44, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.11.0.dmg":       time.Date(2019, time.February, 7, 9, 50, 18, 0, time.UTC),
-
-		// *** 3.11.1 release ***
-		"DB.Browser.for.SQLite-3.11.1-win32.msi": time.Date(2019, time.February, 18, 16, 28, 5, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.11.1-win32.zip": time.Date(2019, time.February, 18, 16, 28, 16, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.11.1-win64.msi": time.Date(2019, time.February, 18, 16, 28, 35, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.11.1-win64.zip": time.Date(2019, time.February, 18, 16, 28, 50, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.11.1.dmg":       time.Date(2019, time.February, 18, 10, 37, 48, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.11.1v2.dmg":     time.Date(2019, time.February, 23, 9, 15, 10, 0, time.UTC),
-
-		// *** 3.11.2 release ***
-		"DB.Browser.for.SQLite-3.11.2-win32.msi":                     time.Date(2019, time.April, 3, 18, 13, 2, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.11.2-win32.zip":                     time.Date(2019, time.April, 3, 18, 13, 16, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.11.2-win64.msi":                     time.Date(2019, time.April, 3, 18, 13, 35, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.11.2-win64.zip":                     time.Date(2019, time.April, 3, 18, 14, 8, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.11.2.dmg":                           time.Date(2019, time.April, 3, 14, 48, 13, 0, time.UTC),
-		"SQLiteDatabaseBrowserPortable_3.11.2_English.paf.exe":       time.Date(2019, time.May, 7, 10, 48, 35, 0, time.UTC),
-		"SQLiteDatabaseBrowserPortable_3.11.2_Rev_2_English.paf.exe": time.Date(2019, time.May, 14, 22, 59, 52, 0, time.UTC),
-
-		// *** 3.12.0 release ***
-		"DB.Browser.for.SQLite-3.12.0-win32.msi":               time.Date(2020, time.June, 15, 18, 18, 1, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.12.0-win32.zip":               time.Date(2020, time.June, 15, 18, 18, 9, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.12.0-win64.msi":               time.Date(2020, time.June, 15, 18, 18, 19, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.12.0-win64.zip":               time.Date(2020, time.June, 15, 18, 18, 37, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.12.0.dmg":                     time.Date(2020, time.June, 14, 7, 24, 20, 0, time.UTC),
-		"SQLiteDatabaseBrowserPortable_3.12.0_English.paf.exe": time.Date(2020, time.June, 18, 4, 59, 35, 0, time.UTC),
-
-		// *** 3.12.2 release ***
-		"DB.Browser.for.SQLite-3.12.2-win32.msi":               time.Date(2021, time.May, 17, 12, 39, 2, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.12.2-win32.zip":               time.Date(2021, time.May, 16, 20, 0, 6, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.12.2-win64.msi":               time.Date(2021, time.May, 17, 12, 39, 16, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.12.2-win64.zip":               time.Date(2021, time.May, 16, 20, 0, 21, 0, time.UTC),
-		"DB.Browser.for.SQLite-3.12.2.dmg":                     time.Date(2021, time.May, 9, 11, 14, 6, 0, time.UTC),
-		"SQLiteDatabaseBrowserPortable_3.12.2_English.paf.exe": time.Date(2021, time.May, 19, 16, 42, 57, 0, time.UTC),
-		"DB_Browser_for_SQLite-v3.12.2-x86_64.AppImage":        time.Date(2021, time.July, 7, 6, 55, 29, 0, time.UTC),
-		"DB.Browser.for.SQLite-arm64-3.12.2.dmg":               time.Date(2022, time.October, 23, 16, 16, 06, 0, time.UTC),
-
-		// *** 3.13.0 release ***
-		"DB.Browser.for.SQLite-v3.13.0.dmg":             time.Date(2024, time.July, 22, 12, 41, 37, 0, time.UTC),
-		"DB.Browser.for.SQLite-v3.13.0-win32.msi":       time.Date(2024, time.July, 22, 12, 41, 37, 0, time.UTC),
-		"DB.Browser.for.SQLite-v3.13.0-win32.zip":       time.Date(2024, time.July, 22, 12, 41, 37, 0, time.UTC),
-		"DB.Browser.for.SQLite-v3.13.0-win64.msi":       time.Date(2024, time.July, 22, 12, 41, 37, 0, time.UTC),
-		"DB.Browser.for.SQLite-v3.13.0-win64.zip":       time.Date(2024, time.July, 22, 12, 41, 37, 0, time.UTC),
-		"DB.Browser.for.SQLite-v3.13.0-x86.64.AppImage": time.Date(2024, time.July, 22, 12, 41, 37, 0, time.UTC),
-
-		// *** 3.13.1 release ***
-		"DB.Browser.for.SQLite-v3.13.1.dmg":                time.Date(2024, time.October, 16, 07, 48, 52, 0, time.UTC),
-		"DB.Browser.for.SQLite-v3.13.1-win32.msi":          time.Date(2024, time.October, 16, 07, 48, 52, 0, time.UTC),
-		"DB.Browser.for.SQLite-v3.13.1-win32.zip":          time.Date(2024, time.October, 16, 07, 48, 52, 0, time.UTC),
-		"DB.Browser.for.SQLite-v3.13.1-win64.msi":          time.Date(2024, time.October, 16, 07, 48, 52, 0, time.UTC),
-		"DB.Browser.for.SQLite-v3.13.1-win64.zip":          time.Date(2024, time.October, 16, 07, 48, 52, 0, time.UTC),
-		"DB.Browser.for.SQLite-v3.13.1-x86.64-v2.AppImage": time.Date(2024, time.October, 18, 17, 33, 53, 0, time.UTC),
-	}
+	// The release catalog, listing the files available for download.  This is swapped out atomically when reloading,
+	// so request handlers should Load() it once and use that copy for the rest of the request
+	catalog atomic.Pointer[ReleaseCatalog]
+
+	// The rules for classifying user agents.  Swapped out atomically when reloading, the same as the release catalog
+	userAgentRules atomic.Pointer[UserAgentRules]
+
+	// The settings which take effect when the configuration file is reloaded.  Swapped out atomically when reloading,
+	// the same as the release catalog.  Everything else in Conf stays as it was at startup
+	liveConf atomic.Pointer[liveSettings]
 
 	// RecordDownloadsLocation controls where downloads are recorded
 	RecordDownloadsLocation = RECORD_NOWHERE
@@ -116,56 +62,100 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Connect to database for recording downloads
-	connectDatabase()
+	// Run a maintenance command instead of the download server, if one was given
+	if len(os.Args) > 1 {
+		err = runCommand(os.Args[1], os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	// Set up Gin
-	router, err := setupRouter(false)
+	// Read the release catalog, and make sure the checksums of the files in it are ready
+	err = readCatalog()
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	// Create the basic HTTP server configuration
-	s := &http.Server{
-		ErrorLog:     HttpErrorLog(),
-		Handler:      router,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
+	loadChecksumCache(Conf.Paths.ChecksumCache)
+	hashAssets(catalog.Load())
+	err = readUserAgentRules()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// If TLS Cert and key file paths are given, then we're using TLS
-	if Conf.TLS.CertFile != "" && Conf.TLS.KeyFile != "" {
-		s.Addr = fmt.Sprintf(":%d", Conf.Server.SSLPort)
-		s.TLSConfig = &tls.Config{
-			MinVersion: tls.VersionTLS12, // TLS 1.2 is now the lowest acceptable level
-		}
-		log.Printf("Listening on port %d...", Conf.Server.SSLPort)
-
-		// Start the server
-		err = s.ListenAndServeTLS(filepath.Join(Conf.TLS.CertFile), filepath.Join(Conf.TLS.KeyFile))
-	} else {
-		// Not using TLS (eg for testing on GitHub Actions)
-		s.Addr = fmt.Sprintf(":%d", Conf.Server.Port)
-		log.Printf("Listening on port %d...", Conf.Server.Port)
+	// Connect to database for recording downloads, and start the background writer for them
+	connectDatabase()
+	startDownloadLogger()
+	if RecordDownloadsLocation == RECORD_IN_PG {
+		// Downloads which couldn't be written to PostgreSQL are saved in a local journal, replayed from here
+		go journalReplayer()
 
-		// Start the server
-		err = s.ListenAndServe()
+		// Keep the download stats up to date
+		if Conf.Stats.AggregateInterval > 0 {
+			go aggregator()
+		}
 	}
+
+	// Set up Gin
+	router, err := setupRouter(false)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Close the database connection gracefully
-	if RecordDownloadsLocation == RECORD_IN_PG {
-		DB.Close()
-	} else if RecordDownloadsLocation == RECORD_IN_SQLITE {
-		sdb.Close()
+	// Reload the config, release catalog, and user agent rules when asked to via SIGHUP, or when the files change
+	go watchForReloads()
+
+	// Start the HTTP and HTTPS servers, and serve the metrics on their own address if one is set
+	servers, errs, err := startServers(router)
+	if err != nil {
+		log.Fatal(err)
 	}
+	servers = append(servers, startMetricsListener())
+
+	// Stop the server when asked to via SIGINT or SIGTERM.  The downloads in progress are given time to finish, then
+	// the queued download records are written before exiting
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		sig := <-stop
+		log.Printf("%s received, shutting down", sig)
+		shutdownServers(time.Duration(Conf.Server.ShutdownTimeout)*time.Second, servers...)
+		close(stopped)
+	}()
+	waitForServers(errs)
+
+	// The servers return as soon as they stop accepting connections, so wait for the requests in progress to finish too
+	<-stopped
+
+	// Write any queued downloads, then close the database connection gracefully
+	closeDatabase()
+	log.Print("Shutdown complete")
 }
 
 // connectDatabase attempts to connect to the backend PostgreSQL database.  If that fails, it connects to a local
 // SQLite database instead.  If *that* fails as well, it just doesn't bother recording downloads.
 func connectDatabase() {
+	err := connectPostgreSQL()
+	if err != nil {
+		err = connectSQLite(sqliteDownloadsFile)
+		if err != nil {
+			// Something went wrong with the SQLite database, so we just turn off recording downloads
+			RecordDownloadsLocation = RECORD_NOWHERE
+		} else {
+			log.Printf("Connecting to PostgreSQL failed, so recording downloads to local SQLite file '%s' instead", sqliteDownloadsFile)
+			RecordDownloadsLocation = RECORD_IN_SQLITE
+		}
+	} else {
+		// Log successful connection
+		log.Printf("Recording downloads to PostgreSQL server: %v:%v", Conf.Pg.Server, uint16(Conf.Pg.Port))
+		RecordDownloadsLocation = RECORD_IN_PG
+	}
+	return
+}
+
+// connectPostgreSQL sets up the PostgreSQL connection pool
+func connectPostgreSQL() (err error) {
 	// Setup the PostgreSQL config
 	pgConfig, err := pgpool.ParseConfig(fmt.Sprintf("host=%s port=%d user= %s password = %s dbname=%s pool_max_conns=%d connect_timeout=10", Conf.Pg.Server, uint16(Conf.Pg.Port), Conf.Pg.Username, Conf.Pg.Password, Conf.Pg.Database, Conf.Pg.NumConnections))
 	if err != nil {
@@ -184,55 +174,94 @@ func connectDatabase() {
 
 	// Connect to PG
 	DB, err = pgpool.New(context.Background(), pgConfig.ConnString())
-	if err != nil {
-		fileName := "DB4S_downloads.sqlite"
-		err = connectSQLite(fileName)
-		if err != nil {
-			// Something went wrong with the SQLite database, so we just turn off recording downloads
-			RecordDownloadsLocation = RECORD_NOWHERE
-		} else {
-			log.Printf("Connecting to PostgreSQL failed, so recording downloads to local SQLite file '%s' instead", fileName)
-			RecordDownloadsLocation = RECORD_IN_SQLITE
-		}
-	} else {
-		// Log successful connection
-		log.Printf("Recording downloads to PostgreSQL server: %v:%v", Conf.Pg.Server, uint16(Conf.Pg.Port))
-		RecordDownloadsLocation = RECORD_IN_PG
-	}
 	return
 }
 
-// currentReleaseHandler serves the "current release" information to users
+// currentReleaseHandler serves the "current release" information to users.  By default this is the two line plain
+// text format DB4S clients expect (version number, then release notes URL), for the newest stable release.  The
+// optional "channel", "os" and "arch" query parameters select a different release channel or platform, and a JSON
+// version (including the download details for the platform) is returned for "format=json"
 func currentReleaseHandler(c *gin.Context) {
-	resp := "3.13.1\nhttps://sqlitebrowser.org/blog/version-3-13-1-released\n"
-	c.String(200, resp)
+	rel, asset, ok := catalog.Load().CurrentRelease(c.Query("channel"), c.Query("os"), c.Query("arch"))
+	if !ok {
+		c.String(http.StatusNotFound, "No matching release found\n")
+		return
+	}
+
+	// Send the plain text version, unless JSON was asked for
+	if c.Query("format") != "json" && c.NegotiateFormat(gin.MIMEPlain, gin.MIMEJSON) != gin.MIMEJSON {
+		c.String(http.StatusOK, fmt.Sprintf("%s\n%s\n", rel.Version, rel.Notes))
+		return
+	}
+	resp := currentReleaseInfo{
+		Version: rel.Version,
+		Channel: rel.Channel,
+		Notes:   rel.Notes,
+	}
+	if asset.Name != "" {
+		scheme := "http"
+		if c.Request.TLS != nil {
+			scheme = "https"
+		}
+		resp.Asset = &currentReleaseAsset{
+			Name:   asset.Name,
+			URL:    fmt.Sprintf("%s://%s/%s", scheme, c.Request.Host, asset.Name),
+			OS:     asset.OS,
+			Arch:   asset.Arch,
+			SHA256: asset.SHA256,
+		}
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
 // Handler for download requests
 func fileHandler(c *gin.Context) {
 	// If the requested file is unknown, then abort
 	fileName := c.Param("filename")
-	ts, ok := timeStamps[fileName]
+	cat := catalog.Load()
+
+	// The checksum files are generated on the fly
+	if fileName == "SHA256SUMS.txt" {
+		checksumsHandler(c, cat)
+		return
+	}
+	if strings.HasSuffix(fileName, ".sha256") {
+		if asset, ok := cat.Asset(strings.TrimSuffix(fileName, ".sha256")); ok {
+			assetChecksumHandler(c, cat, asset)
+			return
+		}
+	}
+
+	asset, ok := cat.Asset(fileName)
 	if !ok {
+		c.AbortWithStatus(http.StatusNotFound)
 		fmt.Fprintf(c.Writer, "Unknown file requested")
 		log.Printf("Unknown file '%s' requested by '%s', aborting", fileName, c.Request.RemoteAddr)
-		c.AbortWithStatus(http.StatusNotFound)
 		return
 	}
 
 	// Retrieve the file size
-	fullPath := filepath.Join(Conf.Paths.DataDir, fileName)
+	fullPath := filepath.Join(cat.paths.DataDir, fileName)
 	info, err := os.Stat(fullPath)
 	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
 		fmt.Fprintf(c.Writer, "Internal server error")
 		log.Printf("Error occured when trying to stat local file '%s': %s", fileName, err)
-		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 	sz := strconv.FormatInt(info.Size(), 10)
 
+	// Refuse to serve files which don't match the checksum in the release catalog
+	_, err = verifyAsset(cat, asset, info)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		fmt.Fprintf(c.Writer, "Internal server error")
+		log.Printf("Refusing to serve local file '%s', as its checksum couldn't be verified: %s", fileName, err)
+		return
+	}
+
 	// Create the format disposition string
-	disp := fmt.Sprintf(`attachment; filename="%s"; modification-date="%s";`, fileName, ts.Format(time.RFC3339))
+	disp := fmt.Sprintf(`attachment; filename="%s"; modification-date="%s";`, fileName, asset.Timestamp.Format(time.RFC3339))
 
 	// Set the headers
 	c.Header("Content-Disposition", disp)
@@ -242,16 +271,16 @@ func fileHandler(c *gin.Context) {
 	// Send the file contents
 	// We use http.ServeContent() here as it allows setting the desired "last modified" timestamp.  The other functions
 	// we could have used instead - c.File() and http.ServeFile() - don't allow this.  Those just read the date of the
-	// file on disk, whereas we want to use timestamp entries matching the GitHub release files
+	// file on disk, whereas we want to use the timestamp entries from the release catalog
 	z, err := os.Open(fullPath)
 	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
 		fmt.Fprintf(c.Writer, "Internal server error")
 		log.Printf("Error occured when trying to open local file '%s': %s", fileName, err)
-		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 	defer z.Close()
-	http.ServeContent(c.Writer, c.Request, fileName, ts, z)
+	serveFile(c, fileName, asset.Timestamp, info.Size(), z)
 }
 
 // logRequest records a download in the backend database
@@ -260,15 +289,26 @@ func logRequest() gin.HandlerFunc {
 		// Execute the other middleware handlers first
 		c.Next()
 
+		// Requests for the stats, metrics, and health checks aren't downloads, so they're not recorded
+		path := c.Request.URL.Path
+		if strings.HasPrefix(path, "/api/") || path == "/stats" || strings.HasPrefix(path, "/stats/") ||
+			path == "/metrics" || path == "/healthz" || path == "/readyz" {
+			return
+		}
+
 		fileName := c.Request.URL.String()
 
-		if debug {
-			log.Printf("Logging download of '%s' (%d bytes) by '%s'", fileName, c.Writer.Size(), c.ClientIP())
+		// Work out the client address, following the forwarding headers added by our trusted proxies
+		live := liveConf.Load()
+		clientAddr := resolveClientAddress(c.Request, live.trustedProxies, live.forwardedHeader)
+
+		if debug.Load() {
+			log.Printf("Logging download of '%s' (%d bytes) by '%s'", fileName, c.Writer.Size(), clientAddr)
 		}
 
 		// If we're recording downloads, then figure out the details
 		if RecordDownloadsLocation != RECORD_NOWHERE {
-			ref := &pgtype.Text{
+			ref := pgtype.Text{
 				String: c.Request.Referer(),
 				Valid:  true,
 			}
@@ -276,256 +316,44 @@ func logRequest() gin.HandlerFunc {
 				ref.Valid = false
 			}
 
-			// Grab the client IP address
-			clientIP := dbEntry{
-				ipv4:      pgtype.Text{Valid: false},
-				ipv6:      pgtype.Text{Valid: false},
-				ipstrange: pgtype.Text{Valid: false},
-				port:      pgtype.Int4{Valid: false},
-			}
-			tempIP := c.Request.Header.Get("X-Forwarded-For")
-			if tempIP == "" {
-				tempIP = c.Request.RemoteAddr
-			}
-			if tempIP != "" {
-				// Determine if client IP address is IPv4 or IPv6, and split out the port number
-				if strings.HasPrefix(tempIP, "[") {
-					// * This is an IPv6 address *
-
-					// When the string starts with "[", it seems to mean this is an IPv6 address with the port number on the
-					// end.  Along the lines of (say) [1:2:3:4:5:6]:789
-					s := strings.SplitN(tempIP, "]:", 2)
-					ip := strings.TrimLeft(s[0], "[")
-
-					// Check for unexpected values
-					if len(s) != 2 {
-						// TODO: We should probably serialise the entire request, and store that instead, to allow for better
-						//       analysis of any weirdness we need to be aware of and/or adjust for
-
-						// We either have too many, or not enough fields.  Either way, store the IP address in the "strange"
-						// database field for future analysis
-						clientIP.ipstrange.String = ip
-						clientIP.ipstrange.Valid = true
-
-					} else {
-						// * In theory, we should have the port number in [s]1 *
-
-						// Convert the port string into a number
-						if s[1] != "" {
-							p, e := strconv.ParseInt(s[1], 10, 32)
-							if e == nil {
-								clientIP.port.Valid = true
-								clientIP.port.Int32 = int32(p)
-
-								// Double check the port number conversion was correct
-								tst := fmt.Sprintf("%d", clientIP.port.Int32)
-								if tst != s[1] {
-									log.Printf("String conversion failed! s[1] = %v, p = %v, int32(p) = %v, port = %v",
-										s[1], p, int32(p), clientIP.port.Int32)
-									clientIP.port.Valid = false
-									clientIP.port.Int32 = 0
-								}
-							} else {
-								log.Printf("Conversion error: %v", e)
-							}
-						}
-
-						// Validate the likely IPv6 address
-						tmp := net.ParseIP(ip)
-						if tmp == nil {
-							// Not a valid IP address, so store the (complete) weird address in the client_ip_strange field
-							// for future investigation.
-							log.Printf("Strange address '%v'", tempIP)
-							clientIP.ipstrange.String = tempIP
-							clientIP.ipstrange.Valid = true
-						}
-
-						// Double check the IP address, by seeing if converting it to a string matches what we were given
-						if tmp.String() != ip {
-							// Something seems a bit off with the IP address, so store it in the client_ip_strange field for
-							// future investigation
-							log.Printf("Strange address '%v'", tempIP)
-							clientIP.ipstrange.String = tempIP
-							clientIP.ipstrange.Valid = true
-						}
-
-						clientIP.ipv6.String = ip
-						clientIP.ipv6.Valid = true
-					}
-				} else {
-					// Client IP address doesn't seem to be in "[IPv6]:port" format, so it's likely IPv4, or IPv6 without a
-					// port number.  The occasional strange value does also turn up (eg 'unknown' or multiple IP's), so we
-					// need to recognise those and handle them as well.
-
-					s := strings.SplitN(tempIP, ":", 2)
-					switch len(s) {
-					case 1:
-						// Most likely an IPv4 address without a port number.  Validate it to make sure.
-						if net.ParseIP(s[0]) == nil {
-							// Not a valid IP address, so store the (complete) weird address in the client_ip_strange field
-							// for future investigation.
-							log.Printf("Strange address '%v'", tempIP)
-							clientIP.ipstrange.String = tempIP
-							clientIP.ipstrange.Valid = true
-							break
-						}
-
-						// Yep, it's just a standard IPv4 address missing a port number
-						clientIP.ipv4.String = s[0]
-						clientIP.ipv4.Valid = true
-
-					case 2:
-						// Most likely an IPv4 address with a port number.  eg 1.2.3.4:56789
-
-						// Validate the IPv4 address
-						if net.ParseIP(s[0]) == nil {
-							// Not a valid IP address, so store the (complete) weird address in the client_ip_strange field
-							// for future investigation.
-							log.Printf("Strange address '%v'", tempIP)
-							clientIP.ipstrange.String = tempIP
-							clientIP.ipstrange.Valid = true
-							break
-						}
-
-						// The IPv4 address is valid, so record that
-						clientIP.ipv4.String = s[0]
-						clientIP.ipv4.Valid = true
-
-						// Validate the port number
-						if s[1] != "" {
-							p, e := strconv.ParseInt(s[1], 10, 32)
-							if e != nil {
-								log.Printf("Conversion error: %v", e)
-								break
-							}
-
-							// Double check the port number conversion was correct
-							tst := fmt.Sprintf("%d", p)
-							if tst != s[1] {
-								log.Printf("String conversion failed! s[1] = %v, p = %v, int32(p) = %v, port = %v",
-									s[1], p, int32(p), clientIP.port.Int32)
-								break
-							}
-
-							// Ensure the port number is in the valid port range (0-65535)
-							if p < 0 || p > 65535 {
-								log.Printf("Port number %v outside valid port range", p)
-								break
-							}
-
-							// Port number seems ok, so record it
-							clientIP.port.Valid = true
-							clientIP.port.Int32 = int32(p)
-						}
-					default:
-						// * Most likely an IPv6 address without a port number.  Along the lines of (say) "1:2:3:4:5:6" *
-
-						// Validate the address
-						ip := net.ParseIP(s[0])
-						if ip == nil {
-							// Not a valid IP address, so store the (complete) weird address in the client_ip_strange field
-							// for future investigation.
-							log.Printf("Strange address '%v'", tempIP)
-							clientIP.ipstrange.String = tempIP
-							clientIP.ipstrange.Valid = true
-							break
-						}
-
-						// Double check the IP address, by seeing if converting it to a string matches what we were given
-						if ip.String() != s[0] {
-							// Something seems a bit off with the IP address, so store it in the client_ip_strange field for
-							// future investigation
-							log.Printf("Strange address '%v'", tempIP)
-							clientIP.ipstrange.String = tempIP
-							clientIP.ipstrange.Valid = true
-							break
-						}
-
-						// Seems ok so far, so lets store it in the IPv6 field
-						clientIP.ipv6.String = s[0]
-						clientIP.ipv6.Valid = true
-					}
-				}
-			} else {
-				// Can't determine client IP address
+			// Split the client address into its database fields, keeping an eye out for anything unusual
+			clientIP, class := parseClientAddress(clientAddr)
+			switch class {
+			case ADDRESS_EMPTY:
 				log.Printf("Unknown client IP address. :(")
+				strangeAddresses.WithLabelValues(string(class)).Inc()
+			case ADDRESS_INVALID, ADDRESS_MULTIPLE, ADDRESS_BAD_PORT:
+				log.Printf("Strange address '%v' (%s)", clientAddr, class)
+				strangeAddresses.WithLabelValues(string(class)).Inc()
 			}
 
-			if RecordDownloadsLocation == RECORD_IN_PG {
-				// Record the download to PostgreSQL
-				dbQuery := `
-					INSERT INTO download_log (
-						client_ipv4, client_ipv6, client_ip_strange, client_port, remote_user, request_time, request_type, request,
-						protocol, status, body_bytes_sent, http_referer, http_user_agent)
-					VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
-				res, err := DB.Exec(context.Background(), dbQuery,
-					// IP address
-					&clientIP.ipv4, &clientIP.ipv6, &clientIP.ipstrange,
-					// client port
-					&clientIP.port,
-					// remote_user
-					&pgtype.Text{String: "", Valid: false}, // Hard coded empty string for now
-					// request_time
-					time.Now().Format(time.RFC3339Nano),
-					// request_type
-					c.Request.Method,
-					// request
-					fileName,
-					// protocol
-					c.Request.Proto,
-					// status
-					c.Writer.Status(),
-					// body_bytes_sent
-					c.Writer.Size(),
-					// http_referer
-					ref,
-					// http_user_agent
-					c.Request.Header.Get("User-Agent"))
-				if err != nil {
-					log.Printf("error when inserting download entry in PostgreSQL: %v", err)
-					return
-				}
-				numRows := res.RowsAffected()
-				if numRows != 1 {
-					log.Printf("something went wrong when inserting a new download entry.  # of entries affected = %d instead of 1", numRows)
-					return
-				}
-			} else {
-				// Record the download in SQLite
-				// Note there's no need to convert the PG data types before hand, as the SQLite library seems ok with them
-				dbQuery := `
-					INSERT INTO download_log (
-						client_ipv4, client_ipv6, client_ip_strange, client_port, remote_user, request_time, request_type, request,
-						protocol, status, body_bytes_sent, http_referer, http_user_agent)
-					VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
-				err := sdb.Exec(dbQuery,
-					// IP address
-					&clientIP.ipv4, &clientIP.ipv6, &clientIP.ipstrange,
-					// client port
-					&clientIP.port,
-					// remote_user
-					&pgtype.Text{String: "", Valid: false}, // Hard coded empty string for now
-					// request_time
-					time.Now().Format(time.RFC3339Nano),
-					// request_type
-					c.Request.Method,
-					// request
-					fileName,
-					// protocol
-					c.Request.Proto,
-					// status
-					c.Writer.Status(),
-					// body_bytes_sent
-					c.Writer.Size(),
-					// http_referer
-					ref,
-					// http_user_agent
-					c.Request.Header.Get("User-Agent"))
-				if err != nil {
-					log.Printf("error when inserting download entry in SQLite: %v", err)
-					return
-				}
+			// Queue the download for the background writer to record, with how much of the file was sent, the details
+			// of the DB4S download (if it is one) and the kind of client, anonymising the client address first if needed
+			rec := downloadRecord{
+				ClientIPv4:      clientIP.ipv4,
+				ClientIPv6:      clientIP.ipv6,
+				ClientIPStrange: clientIP.ipstrange,
+				ClientPort:      clientIP.port,
+				RemoteUser:      pgtype.Text{String: "", Valid: false}, // Hard coded empty string for now
+				RequestTime:     time.Now(),
+				RequestType:     c.Request.Method,
+				Request:         fileName,
+				Protocol:        c.Request.Proto,
+				Status:          c.Writer.Status(),
+				BodyBytesSent:   c.Writer.Size(),
+				HTTPReferer:     ref,
+				HTTPUserAgent:   c.Request.Header.Get("User-Agent"),
+				EventID:         newEventID(),
+				ForwardedHeader: forwardedHeaders(c.Request),
+			}
+			if p, ok := c.Get(downloadProgressKey); ok {
+				rec.setCompletion(p.(*downloadProgress), clientIP.ipv4.String+clientIP.ipv6.String+
+					clientIP.ipstrange.String)
 			}
+			rec.setAsset()
+			rec.setUserAgentClass(userAgentRules.Load())
+			anonymiseDownload(&rec, Conf.Privacy)
+			queueDownload(rec)
 		}
 		return
 	}
@@ -533,7 +361,7 @@ func logRequest() gin.HandlerFunc {
 
 func readConfig() (err error) {
 	// Override config file location via environment variables
-	configFile := os.Getenv("CONFIG_FILE")
+	configFile = os.Getenv("CONFIG_FILE")
 	if configFile == "" {
 		// TODO: Might be a good idea to add permission checks of the dir & conf file, to ensure they're not
 		//       world readable.  Similar in concept to what ssh does for its config files.
@@ -545,22 +373,44 @@ func readConfig() (err error) {
 	}
 
 	// Read our configuration settings
-	if _, err = toml.DecodeFile(configFile, &Conf); err != nil {
+	Conf, err = loadConfig(configFile)
+	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Enable debugging output, if the option is set in the config file
+	debug.Store(Conf.Server.Debug)
+	liveConf.Store(newLiveSettings(Conf))
+
+	return
+}
+
+// loadConfig reads the configuration settings from the given file, then applies any environment variable overrides
+func loadConfig(fileName string) (conf TomlConfig, err error) {
+	if _, err = toml.DecodeFile(fileName, &conf); err != nil {
+		return
+	}
+	setLoggingDefaults(&conf.Logging)
+	setServerDefaults(&conf.Server)
+	setGitHubDefaults(&conf.GitHub)
+	err = setPrivacyDefaults(&conf.Privacy)
+	if err != nil {
+		return
+	}
+	err = setACMEDefaults(&conf.ACME, conf.Paths, conf.TLS)
+	if err != nil {
+		return
+	}
+	conf.Server.trustedProxies, err = parseTrustedProxies(conf.Server.TrustedProxies)
+	if err != nil {
+		return
+	}
+
 	// Apply any environment variable configuration overrides
 	z := os.Getenv("DEBUG")
 	if z != "" {
-		Conf.Server.Debug, err = strconv.ParseBool(z)
-		if err != nil {
-			log.Fatal(err)
-		}
+		conf.Server.Debug, err = strconv.ParseBool(z)
 	}
-
-	// Enable debugging output, if the option is set in the config file
-	debug = Conf.Server.Debug
-
 	return
 }
 
@@ -574,23 +424,29 @@ func maxSizeMiddleware(maxSize int64) gin.HandlerFunc {
 
 // rootHandler serves the html index page that lists the available downloads
 func rootHandler(c *gin.Context) {
-	c.HTML(http.StatusOK, "downloads", nil)
+	c.HTML(http.StatusOK, "downloads", catalog.Load())
 }
 
 func setupRouter(testingMode bool) (router *gin.Engine, err error) {
 	// We turn off Gins' debug mode when testing, and when debug mode is turned off in normal operation
-	if testingMode || !debug {
+	if testingMode || !debug.Load() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
 	// Set up Gin
 	router = gin.New()
 	router.Use(gin.Recovery())
-	if debug {
+
+	// Count and time the requests
+	router.Use(metricsMiddleware())
+	if debug.Load() {
 		// We only use the Gin Logger middleware when debugging is turned on
 		router.Use(gin.Logger())
 	}
 
+	// Give each response a deadline to be sent by, which the file transfers keep extending while data is moving
+	router.Use(writeDeadlineMiddleware())
+
 	// Limit the maximum size (in bytes) of incoming requests
 	router.Use(maxSizeMiddleware(8192)) // 8k seems like a reasonable max size
 
@@ -600,13 +456,34 @@ func setupRouter(testingMode bool) (router *gin.Engine, err error) {
 	// Log requests to PostgreSQL
 	router.Use(logRequest())
 
-	// Load our HTML template
+	// Load our HTML template.  The asset descriptions in the release catalog are allowed to contain html
+	router.SetFuncMap(template.FuncMap{
+		"safeHTML": func(s string) template.HTML { return template.HTML(s) },
+	})
 	router.LoadHTMLGlob(filepath.Join(Conf.Paths.BaseDir, "template.html"))
 
 	// Register handlers
 	router.GET("/", rootHandler)
 	router.GET("/:filename", fileHandler)
 	router.GET("/currentrelease", currentReleaseHandler)
+	router.GET("/healthz", healthzHandler)
+	router.GET("/readyz", readyzHandler(router))
 	router.StaticFile("/favicon.ico", filepath.Join(Conf.Paths.BaseDir, "favicon.ico"))
+
+	// The stats API, for our dashboards
+	api := router.Group("/api/stats", tokenAuth("Bearer"))
+	api.GET("/downloads", statsHandler(downloadStats, true))
+	api.GET("/users", statsHandler(userStats, false))
+
+	// Exports of the raw download log
+	router.GET("/api/export", exportAuth(), exportHandler)
+
+	// The metrics, unless they're served separately.  They need the stats API token here, as this is public
+	if Conf.Metrics.Listen == "" {
+		router.GET("/metrics", tokenAuth("Bearer"), gin.WrapH(metricsHandler()))
+	}
+
+	// The stats dashboard
+	addDashboardRoutes(router)
 	return
 }
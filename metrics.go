@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// The registry for our metrics.  A separate one from the Prometheus default is used, so only the metrics set up
+	// here are exported
+	metricsRegistry = prometheus.NewRegistry()
+
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db4s_http_requests_total",
+		Help: "Number of HTTP requests, by route and response status.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "db4s_http_request_duration_seconds",
+		Help: "Time taken to answer HTTP requests, by route and response status.",
+
+		// Downloads of the larger files can take minutes over slow connections
+		Buckets: []float64{0.005, 0.025, 0.1, 0.5, 1, 5, 15, 60, 300, 1200},
+	}, []string{"route", "status"})
+
+	assetBytesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db4s_asset_bytes_sent_total",
+		Help: "Bytes of each release catalog file sent, before any compression.",
+	}, []string{"asset"})
+
+	activeDownloads = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "db4s_active_downloads",
+		Help: "Number of files currently being sent.",
+	})
+
+	strangeAddresses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db4s_strange_client_addresses_total",
+		Help: "Number of requests whose client address wasn't a normal IP address, by the problem found.",
+	}, []string{"class"})
+
+	checksumCalculations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "db4s_checksum_calculations_total",
+		Help: "Number of times a file was read to calculate its checksum.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpRequestDuration,
+		assetBytesSent,
+		activeDownloads,
+		strangeAddresses,
+		checksumCalculations,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "db4s_download_queue_length",
+			Help: "Number of download records waiting to be written to the database.",
+		}, func() float64 {
+			downloadQueueMu.Lock()
+			defer downloadQueueMu.Unlock()
+			return float64(len(downloadQueue))
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "db4s_download_records_dropped_total",
+			Help: "Number of download records dropped because the queue was full.",
+		}, func() float64 {
+			return float64(droppedDownloads.Load())
+		}),
+		databaseCollector{},
+		tlsCertCollector{},
+	)
+}
+
+// The names the metrics use for where downloads are recorded
+var recordLocationNames = map[RecordDownloads]string{
+	RECORD_IN_PG:     "pg",
+	RECORD_IN_SQLITE: "sqlite",
+	RECORD_NOWHERE:   "nowhere",
+}
+
+var (
+	recordLocationDesc = prometheus.NewDesc("db4s_record_downloads_location",
+		"Where downloads are being recorded.  The location label with the value 1 is the one in use.",
+		[]string{"location"}, nil)
+	pgConnsDesc = prometheus.NewDesc("db4s_pg_pool_connections",
+		"Number of connections in the PostgreSQL pool, by state.", []string{"state"}, nil)
+	pgMaxConnsDesc = prometheus.NewDesc("db4s_pg_pool_max_connections",
+		"Maximum size of the PostgreSQL pool.", nil, nil)
+	pgAcquiresDesc = prometheus.NewDesc("db4s_pg_pool_acquires_total",
+		"Number of connections acquired from the PostgreSQL pool.", nil, nil)
+	pgEmptyAcquiresDesc = prometheus.NewDesc("db4s_pg_pool_empty_acquires_total",
+		"Number of connections acquired from the PostgreSQL pool which had to wait for one.", nil, nil)
+	pgCanceledAcquiresDesc = prometheus.NewDesc("db4s_pg_pool_canceled_acquires_total",
+		"Number of attempts to acquire a connection from the PostgreSQL pool which were canceled.", nil, nil)
+	pgAcquireDurationDesc = prometheus.NewDesc("db4s_pg_pool_acquire_duration_seconds_total",
+		"Total time spent acquiring connections from the PostgreSQL pool.", nil, nil)
+)
+
+// databaseCollector reports where downloads are recorded, along with the PostgreSQL connection pool stats when it's
+// being used.  These are read when the metrics are scraped, rather than being kept up to date
+type databaseCollector struct{}
+
+func (databaseCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(databaseCollector{}, ch)
+}
+
+func (databaseCollector) Collect(ch chan<- prometheus.Metric) {
+	for loc, name := range recordLocationNames {
+		v := 0.0
+		if loc == RecordDownloadsLocation {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(recordLocationDesc, prometheus.GaugeValue, v, name)
+	}
+	if RecordDownloadsLocation != RECORD_IN_PG || DB == nil {
+		return
+	}
+	s := DB.Stat()
+	ch <- prometheus.MustNewConstMetric(pgConnsDesc, prometheus.GaugeValue, float64(s.AcquiredConns()), "acquired")
+	ch <- prometheus.MustNewConstMetric(pgConnsDesc, prometheus.GaugeValue, float64(s.IdleConns()), "idle")
+	ch <- prometheus.MustNewConstMetric(pgConnsDesc, prometheus.GaugeValue, float64(s.ConstructingConns()),
+		"constructing")
+	ch <- prometheus.MustNewConstMetric(pgMaxConnsDesc, prometheus.GaugeValue, float64(s.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(pgAcquiresDesc, prometheus.CounterValue, float64(s.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(pgEmptyAcquiresDesc, prometheus.CounterValue, float64(s.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(pgCanceledAcquiresDesc, prometheus.CounterValue,
+		float64(s.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(pgAcquireDurationDesc, prometheus.CounterValue, s.AcquireDuration().Seconds())
+}
+
+var tlsCertExpiryDesc = prometheus.NewDesc("db4s_tls_certificate_expiry_timestamp_seconds",
+	"When the TLS certificate being served expires, as a Unix timestamp.", nil, nil)
+
+// tlsCertCollector reports when the TLS certificate loaded from the certfile and keyfile settings expires, following it
+// as renewed certificates are reloaded.  Nothing is reported when the certificates don't come from files
+type tlsCertCollector struct{}
+
+func (tlsCertCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tlsCertExpiryDesc
+}
+
+func (tlsCertCollector) Collect(ch chan<- prometheus.Metric) {
+	cert := tlsCert.Load()
+	if cert == nil || cert.Leaf == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(tlsCertExpiryDesc, prometheus.GaugeValue, float64(cert.Leaf.NotAfter.Unix()))
+}
+
+// metricsMiddleware counts and times the requests, labelled by the route matched rather than the full path so the
+// number of different labels stays small
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequests.WithLabelValues(route, c.Request.Method, status).Inc()
+		httpRequestDuration.WithLabelValues(route, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// metricsHandler serves the metrics in the Prometheus text format
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{ErrorLog: log.Default()})
+}
+
+// startMetricsListener serves the metrics on their own address, when one is set in the [metrics] section of the
+// config file.  This keeps them off the public download server, so no token is needed to read them
+func startMetricsListener() (s *http.Server) {
+	if Conf.Metrics.Listen == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+	s = &http.Server{
+		Addr:         Conf.Metrics.Listen,
+		ErrorLog:     HttpErrorLog(),
+		Handler:      mux,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	go func() {
+		log.Printf("Serving metrics on %s...", Conf.Metrics.Listen)
+		err := s.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("The metrics listener failed: %v", err)
+		}
+	}()
+	return
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	router := statsTestRouter(t)
+	get := func(url, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// The metrics need the stats API token when they're on the main server
+	assert.Equal(t, 401, get("/metrics", "").Code)
+
+	// Requests are counted by route rather than by path
+	assert.Equal(t, 404, get("/no-such-file.dmg", "").Code)
+	w := get("/metrics", "secret")
+	require.Equal(t, 200, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, `db4s_http_requests_total{method="GET",route="/:filename",status="404"}`)
+	assert.Contains(t, body, `db4s_record_downloads_location{location="sqlite"} 1`)
+	assert.Contains(t, body, `db4s_record_downloads_location{location="pg"} 0`)
+	assert.Contains(t, body, "db4s_download_queue_length")
+	assert.Contains(t, body, "db4s_active_downloads 0")
+
+	// Requests for the metrics aren't recorded as downloads
+	stopDownloadLogger()
+	var n int
+	require.NoError(t, sdb.OneValue(`SELECT count(*) FROM download_log WHERE request = '/metrics'`, &n))
+	assert.Equal(t, 0, n)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Stored in place of client addresses which can't be truncated, as they're not a single valid IP address
+const anonymisedAddress = "anonymised"
+
+// setPrivacyDefaults fills in the privacy settings not given in the config file, and checks the ones which were.
+// Unlike most settings, mistakes here aren't quietly replaced with the defaults, as that could mean recording
+// addresses which were meant to be anonymised
+func setPrivacyDefaults(p *PrivacyInfo) error {
+	switch p.Anonymise {
+	case "":
+		p.Anonymise = "none"
+	case "none", "truncate":
+	case "hmac":
+		if p.HMACKey == "" {
+			return errors.New("the hmac_key privacy setting is needed to anonymise addresses with 'hmac'")
+		}
+	default:
+		return fmt.Errorf("unknown anonymise privacy setting '%s', it should be none, truncate, or hmac", p.Anonymise)
+	}
+	if p.SaltRotation <= 0 {
+		p.SaltRotation = 24
+	}
+	switch p.RetentionAction {
+	case "":
+		p.RetentionAction = "delete"
+	case "delete", "anonymise":
+	default:
+		return fmt.Errorf("unknown retention_action privacy setting '%s', it should be delete or anonymise",
+			p.RetentionAction)
+	}
+	return nil
+}
+
+// anonymiseDownload anonymises the client address of a download record before it's recorded, as set in the [privacy]
+// section of the config file.  The client port and forwarding headers are removed as well, as they could be used to
+// identify the client
+func anonymiseDownload(r *downloadRecord, p PrivacyInfo) {
+	switch p.Anonymise {
+	case "truncate":
+		for _, t := range []*pgtype.Text{&r.ClientIPv4, &r.ClientIPv6, &r.ClientIPStrange} {
+			if t.Valid {
+				t.String = truncateAddress(t.String)
+			}
+		}
+	case "hmac":
+		ps := &pseudonymiser{key: hmacSalt(p, r.RequestTime)}
+		ps.apply(r)
+		return
+	default:
+		return
+	}
+	r.ClientPort = pgtype.Int4{}
+	r.ForwardedHeader = pgtype.Text{}
+}
+
+// truncateAddress removes the host part of an IP address, leaving the /24 network for IPv4 addresses and the /48
+// network for IPv6 ones.  Anything else is replaced completely
+func truncateAddress(addr string) string {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil || ip.Zone() != "" {
+		return anonymisedAddress
+	}
+	bits := 48
+	if ip.Is4() {
+		bits = 24
+	}
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		return anonymisedAddress
+	}
+	return prefix.Addr().String()
+}
+
+// isPseudonym returns whether a stored client address has already been replaced by its HMAC pseudonym (with
+// anonymise = "hmac").  These are left alone by the retention policy, as they don't identify anyone, and replacing
+// them all with the same value would leave only a single user in the users stats
+func isPseudonym(addr string) bool {
+	if len(addr) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(addr)
+	return err == nil
+}
+
+// hmacSalt returns the salt used for pseudonymising addresses recorded at the given time.  A new salt is derived from
+// the configured key every salt_rotation hours, so the same address gets the same pseudonym within a rotation period
+// (and across servers sharing the key), but they can't be linked up over longer times
+func hmacSalt(p PrivacyInfo, t time.Time) []byte {
+	period := t.Unix() / (int64(p.SaltRotation) * 3600)
+	mac := hmac.New(sha256.New, []byte(p.HMACKey))
+	mac.Write([]byte(strconv.FormatInt(period, 10)))
+	return mac.Sum(nil)
+}
+
+// retentionCommand deletes or anonymises the download_log rows older than the retention period, the same as is done
+// after each scheduled aggregation
+func retentionCommand(args []string) (err error) {
+	flags := flag.NewFlagSet("retention", flag.ContinueOnError)
+	err = flags.Parse(args)
+	if err != nil {
+		return
+	}
+	if Conf.Privacy.RetentionDays <= 0 {
+		return errors.New("no retention period is set, so download_log is kept forever")
+	}
+	err = connectPostgreSQL()
+	if err == nil {
+		defer DB.Close()
+		err = DB.Ping(context.Background())
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't connect to PostgreSQL: %w", err)
+	}
+	return applyRetention(context.Background(), Conf.Privacy)
+}
+
+// applyRetention deletes or anonymises the download_log rows older than the retention period.  Only rows in weeks and
+// months whose stats have been calculated for the last time are touched (see retentionBoundary), so nothing is lost
+// from the stats.  The user agents are kept, as the users stats can't be recalculated without them
+func applyRetention(ctx context.Context, p PrivacyInfo) (err error) {
+	if p.RetentionDays <= 0 {
+		return
+	}
+
+	// Find how far the aggregation has got
+	var (
+		lastAggregated  int64
+		aggregatedUntil time.Time
+	)
+	err = DB.QueryRow(ctx, `
+		SELECT last_download_id, aggregated_until
+		FROM db4s_aggregate_state
+		WHERE name = 'download_log'`).Scan(&lastAggregated, &aggregatedUntil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		log.Print("The download stats haven't been calculated yet, so no old downloads were removed")
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	cutoff := retentionBoundary(time.Now().AddDate(0, 0, -p.RetentionDays), aggregatedUntil)
+
+	var n int64
+	switch p.RetentionAction {
+	case "delete":
+		n, err = deleteOldDownloads(ctx, cutoff, lastAggregated)
+	case "anonymise":
+		n, err = anonymiseOldDownloads(ctx, cutoff, lastAggregated, Conf.Logging.BatchSize)
+	}
+	if err != nil {
+		return
+	}
+	if n > 0 {
+		log.Printf("Retention policy applied to download_log, %d downloads from before %s were %sd", n,
+			cutoff.UTC().Format(time.DateOnly), p.RetentionAction)
+	}
+	return
+}
+
+// retentionBoundary returns the time download_log rows need to be older than for the retention policy to touch them.
+// The stats for a whole week or month are recalculated from download_log whenever a download in it is aggregated, so
+// removing or anonymising rows in a period which is still going would replace its totals with smaller ones.  Instead,
+// rows are only touched once every period they're in had ended before the last aggregation run, which means going
+// back from the cutoff to the start of its month, and then to the start of the week that falls in
+func retentionBoundary(cutoff, aggregatedUntil time.Time) time.Time {
+	if aggregatedUntil.Before(cutoff) {
+		cutoff = aggregatedUntil
+	}
+	return periodStart("week", periodStart("month", cutoff))
+}
+
+// deleteOldDownloads removes the aggregated download_log rows from before the cutoff time.  The same lock as the
+// aggregation is taken, so rows can't be removed while their periods are being recalculated
+func deleteOldDownloads(ctx context.Context, cutoff time.Time, lastAggregated int64) (n int64, err error) {
+	err = pgx.BeginFunc(ctx, DB, func(tx pgx.Tx) (err error) {
+		_, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('db4s_aggregate'))`)
+		if err != nil {
+			return
+		}
+		tag, err := tx.Exec(ctx, `
+			DELETE FROM download_log
+			WHERE request_time < $1
+				AND download_id <= $2`, cutoff, lastAggregated)
+		if err != nil {
+			return
+		}
+		n = tag.RowsAffected()
+
+		// Remember how far back rows have been removed, so the aggregation doesn't recalculate those periods
+		_, err = tx.Exec(ctx, `
+			INSERT INTO db4s_aggregate_state AS s (name, last_download_id, aggregated_until)
+			VALUES ('retention', 0, $1)
+			ON CONFLICT (name) DO UPDATE
+				SET aggregated_until = greatest(s.aggregated_until, EXCLUDED.aggregated_until)`, cutoff)
+		return
+	})
+	return
+}
+
+// anonymiseOldDownloads truncates the client addresses of the aggregated download_log rows from before the cutoff
+// time, and removes their client ports and forwarding headers (and the full address, for rows recorded by old
+// versions of this program).  This is done in batches, working through download_log in order, with the progress kept
+// in db4s_aggregate_state so rows are only ever anonymised once.  It stops at the first row which is still too new
+func anonymiseOldDownloads(ctx context.Context, cutoff time.Time, lastAggregated int64, batchSize int) (n int64, err error) {
+	type oldDownload struct {
+		id              int64
+		requestTime     time.Time
+		ipv4, ipv6, ipx pgtype.Text
+	}
+	for done := false; !done; {
+		err = pgx.BeginFunc(ctx, DB, func(tx pgx.Tx) (err error) {
+			_, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('db4s_aggregate'))`)
+			if err != nil {
+				return
+			}
+			var lastID int64
+			err = tx.QueryRow(ctx, `
+				SELECT last_download_id
+				FROM db4s_aggregate_state
+				WHERE name = 'retention'`).Scan(&lastID)
+			if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+				return
+			}
+
+			// Retrieve the next batch of rows
+			rows, err := tx.Query(ctx, `
+				SELECT download_id, coalesce(request_time, 'epoch'), client_ipv4, client_ipv6, client_ip_strange
+				FROM download_log
+				WHERE download_id > $1 AND download_id <= $2
+				ORDER BY download_id
+				LIMIT $3`, lastID, lastAggregated, batchSize)
+			if err != nil {
+				return
+			}
+			var old []oldDownload
+			for rows.Next() {
+				var d oldDownload
+				err = rows.Scan(&d.id, &d.requestTime, &d.ipv4, &d.ipv6, &d.ipx)
+				if err != nil {
+					rows.Close()
+					return
+				}
+				old = append(old, d)
+			}
+			rows.Close()
+			if err = rows.Err(); err != nil {
+				return
+			}
+			done = len(old) < batchSize
+
+			// Anonymise them, stopping at the first one which is still too new
+			var batch pgx.Batch
+			for _, d := range old {
+				if !d.requestTime.Before(cutoff) {
+					done = true
+					break
+				}
+				for _, t := range []*pgtype.Text{&d.ipv4, &d.ipv6, &d.ipx} {
+					if t.Valid && !isPseudonym(t.String) {
+						t.String = truncateAddress(t.String)
+					}
+				}
+				batch.Queue(`
+					UPDATE download_log
+					SET client_ipv4 = $2, client_ipv6 = $3, client_ip_strange = $4, client_port = NULL,
+						forwarded_header = NULL, remote_addr = NULL
+					WHERE download_id = $1`, d.id, d.ipv4, d.ipv6, d.ipx)
+				lastID = d.id
+			}
+			if batch.Len() == 0 {
+				return
+			}
+			batch.Queue(`
+				INSERT INTO db4s_aggregate_state AS s (name, last_download_id, aggregated_until)
+				VALUES ('retention', $1, $2)
+				ON CONFLICT (name) DO UPDATE
+					SET last_download_id = EXCLUDED.last_download_id,
+						aggregated_until = greatest(s.aggregated_until, EXCLUDED.aggregated_until)`,
+				lastID, cutoff)
+			err = tx.SendBatch(ctx, &batch).Close()
+			if err == nil {
+				n += int64(batch.Len() - 1)
+			}
+			return
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
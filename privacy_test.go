@@ -0,0 +1,215 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnonymiseDownload(t *testing.T) {
+	when := time.Date(2024, 10, 14, 10, 0, 0, 0, time.UTC)
+	rec := func(ipv4, ipv6, strange string) downloadRecord {
+		text := func(s string) pgtype.Text {
+			return pgtype.Text{String: s, Valid: s != ""}
+		}
+		return downloadRecord{
+			ClientIPv4:      text(ipv4),
+			ClientIPv6:      text(ipv6),
+			ClientIPStrange: text(strange),
+			ClientPort:      pgtype.Int4{Int32: 54321, Valid: true},
+			RequestTime:     when,
+			ForwardedHeader: text("X-Forwarded-For: " + ipv4 + ipv6 + strange),
+		}
+	}
+
+	// Nothing is changed unless asked for
+	r := rec("192.0.2.123", "", "")
+	anonymiseDownload(&r, PrivacyInfo{Anonymise: "none"})
+	assert.Equal(t, rec("192.0.2.123", "", ""), r)
+
+	// Truncating
+	p := PrivacyInfo{Anonymise: "truncate"}
+	r = rec("192.0.2.123", "", "")
+	anonymiseDownload(&r, p)
+	assert.Equal(t, "192.0.2.0", r.ClientIPv4.String)
+	assert.False(t, r.ClientPort.Valid)
+	assert.False(t, r.ForwardedHeader.Valid)
+	r = rec("", "2001:db8:1234:5678::1", "")
+	anonymiseDownload(&r, p)
+	assert.Equal(t, "2001:db8:1234::", r.ClientIPv6.String)
+	assert.False(t, r.ClientIPv4.Valid)
+	r = rec("", "", "192.0.2.1, 198.51.100.1")
+	anonymiseDownload(&r, p)
+	assert.Equal(t, anonymisedAddress, r.ClientIPStrange.String)
+
+	// HMAC pseudonyms stay the same within a salt rotation period, but not between them
+	p = PrivacyInfo{Anonymise: "hmac", HMACKey: "key", SaltRotation: 24}
+	pseudonym := func(ip string, at time.Time, p PrivacyInfo) string {
+		r := rec(ip, "", "")
+		r.RequestTime = at
+		anonymiseDownload(&r, p)
+		assert.False(t, r.ClientPort.Valid)
+		assert.False(t, r.ForwardedHeader.Valid)
+		return r.ClientIPv4.String
+	}
+	first := pseudonym("192.0.2.1", when, p)
+	assert.Len(t, first, 16)
+	assert.NotContains(t, first, "192.0.2")
+	assert.Equal(t, first, pseudonym("192.0.2.1", when.Add(13*time.Hour), p))
+	assert.NotEqual(t, first, pseudonym("192.0.2.2", when, p))
+	assert.NotEqual(t, first, pseudonym("192.0.2.1", when.Add(24*time.Hour), p))
+	assert.NotEqual(t, first, pseudonym("192.0.2.1", when, PrivacyInfo{Anonymise: "hmac", HMACKey: "other",
+		SaltRotation: 24}))
+}
+
+func TestSetPrivacyDefaults(t *testing.T) {
+	var p PrivacyInfo
+	require.NoError(t, setPrivacyDefaults(&p))
+	assert.Equal(t, PrivacyInfo{Anonymise: "none", RetentionAction: "delete", SaltRotation: 24}, p)
+
+	assert.Error(t, setPrivacyDefaults(&PrivacyInfo{Anonymise: "hmac"}))
+	assert.Error(t, setPrivacyDefaults(&PrivacyInfo{Anonymise: "hash"}))
+	assert.Error(t, setPrivacyDefaults(&PrivacyInfo{RetentionAction: "archive"}))
+	assert.NoError(t, setPrivacyDefaults(&PrivacyInfo{Anonymise: "hmac", HMACKey: "key"}))
+}
+
+func TestRetentionBoundary(t *testing.T) {
+	day := func(s string) time.Time {
+		d, err := time.Parse(time.DateOnly, s)
+		require.NoError(t, err)
+		return d
+	}
+
+	// Going back to the start of the month, then the week that's in.  1st October 2024 was a Tuesday
+	assert.Equal(t, day("2024-09-30"), retentionBoundary(day("2024-10-16"), day("2024-10-17")))
+	assert.Equal(t, day("2024-07-01"), retentionBoundary(day("2024-07-20"), day("2024-10-17")))
+
+	// Periods which hadn't ended when the stats were last calculated aren't touched
+	assert.Equal(t, day("2024-08-26"), retentionBoundary(day("2024-10-16"), day("2024-09-10")))
+
+	// Model the stats tables the same way aggregateRange fills them in, with whole periods recalculated from the rows
+	// still in download_log, replacing the previous totals.  Periods the retention policy has been applied to are skipped
+	type download struct {
+		when time.Time
+		ip   string
+	}
+	aggregateRetained := func(stats map[string]int, rows []download, first, last, retained time.Time) {
+		for _, p := range aggregatePeriods {
+			start := periodStart(p.unit, first)
+			if from := recalculateFrom(p.unit, retained); start.Before(from) {
+				start = from
+			}
+			downloads, users := make(map[string]int), make(map[string]map[string]bool)
+			for _, r := range rows {
+				if r.when.Before(start) || !r.when.Before(periodEnd(p.unit, last)) {
+					continue
+				}
+				k := p.unit + " " + periodStart(p.unit, r.when).Format(time.DateOnly)
+				downloads[k]++
+				if users[k] == nil {
+					users[k] = make(map[string]bool)
+				}
+				users[k][r.ip] = true
+			}
+			for k, n := range downloads {
+				stats["downloads "+k] = n
+				stats["users "+k] = len(users[k])
+			}
+		}
+	}
+	aggregate := func(stats map[string]int, rows []download, first, last time.Time) {
+		aggregateRetained(stats, rows, first, last, time.Time{})
+	}
+	var rows []download
+	for d := day("2024-08-01"); d.Before(day("2024-10-17")); d = d.AddDate(0, 0, 1) {
+		rows = append(rows, download{d.Add(10 * time.Hour), "192.0.2.1"}, download{d.Add(14 * time.Hour),
+			"192.0.2." + strconv.Itoa(d.Day())})
+	}
+	stats := make(map[string]int)
+	aggregate(stats, rows, rows[0].when, rows[len(rows)-1].when)
+	want := make(map[string]int)
+	for k, v := range stats {
+		want[k] = v
+	}
+
+	// Apply a 7 day retention period, shorter than the weeks and months, then aggregate a new download.  Only the new download's periods change
+	now := day("2024-10-17").Add(12 * time.Hour)
+	applyRetention := func(cutoff time.Time) (kept []download) {
+		for _, r := range rows {
+			if !r.when.Before(cutoff) {
+				kept = append(kept, r)
+			}
+		}
+		return append(kept, download{now, "198.51.100.1"})
+	}
+	kept := applyRetention(retentionBoundary(now.AddDate(0, 0, -7), now))
+	assert.Less(t, len(kept), len(rows))
+	aggregate(stats, kept, now, now)
+	for _, p := range aggregatePeriods {
+		k := p.unit + " " + periodStart(p.unit, now).Format(time.DateOnly)
+		want["downloads "+k]++
+		want["users "+k]++
+	}
+	assert.Equal(t, want, stats)
+
+	// Without going back to the start of the periods, the totals for the current week and month would be cut
+	stats = make(map[string]int)
+	aggregate(stats, rows, rows[0].when, rows[len(rows)-1].when)
+	aggregate(stats, applyRetention(now.AddDate(0, 0, -7)), now, now)
+	assert.NotEqual(t, want, stats)
+
+	// Only whole periods after the retention boundary are recalculated.  It's the start of a week, but not of a month
+	retained := retentionBoundary(now.AddDate(0, 0, -7), now)
+	assert.Equal(t, day("2024-09-30"), recalculateFrom("day", retained))
+	assert.Equal(t, day("2024-09-30"), recalculateFrom("week", retained))
+	assert.Equal(t, day("2024-10-01"), recalculateFrom("month", retained))
+	assert.Equal(t, time.Time{}, recalculateFrom("month", time.Time{}))
+
+	// Downloads turning up late (eg from import-sqlite) in periods the retention policy has been applied to are added
+	// to the existing download counts (as addLateDownloads does), rather than the periods being recalculated from the
+	// rows which are left
+	late := []download{{day("2024-08-15").Add(9 * time.Hour), "203.0.113.5"},
+		{day("2024-09-30").Add(18 * time.Hour), "203.0.113.6"}}
+	lateAggregate := func(stats map[string]int, retained time.Time) {
+		withLate := append(append([]download{}, kept...), late...)
+		aggregateRetained(stats, withLate, late[0].when, late[1].when, retained)
+		for _, p := range aggregatePeriods {
+			for _, r := range late {
+				if r.when.Before(recalculateFrom(p.unit, retained)) {
+					stats["downloads "+p.unit+" "+periodStart(p.unit, r.when).Format(time.DateOnly)]++
+				}
+			}
+		}
+	}
+	stats = make(map[string]int)
+	for k, v := range want {
+		stats[k] = v
+	}
+	lateAggregate(stats, retained)
+	for _, p := range aggregatePeriods {
+		for _, r := range late {
+			want["downloads "+p.unit+" "+periodStart(p.unit, r.when).Format(time.DateOnly)]++
+		}
+	}
+	want["users day 2024-09-30"]++
+	want["users week 2024-09-30"]++
+	assert.Equal(t, want, stats)
+
+	// Recalculating the pruned periods instead would replace their totals with those of the few rows left
+	stats = make(map[string]int)
+	aggregate(stats, rows, rows[0].when, rows[len(rows)-1].when)
+	aggregate(stats, kept, now, now)
+	lateAggregate(stats, time.Time{})
+	assert.NotEqual(t, want, stats)
+	assert.Equal(t, 1, stats["downloads month 2024-08-01"])
+
+	// HMAC pseudonyms are recognised, so they're not replaced when anonymising old rows
+	assert.True(t, isPseudonym("0123456789abcdef"))
+	assert.False(t, isPseudonym("192.0.2.123"))
+	assert.False(t, isPseudonym("2001:db8:1234::"))
+	assert.False(t, isPseudonym(anonymisedAddress))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fileState holds the details used to tell when a file has changed on disk
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+var (
+	// Ensures only one reload runs at a time
+	reloadMu sync.Mutex
+)
+
+// watchForReloads reloads the configuration, release catalog, and user agent rules when SIGHUP is received, or when any
+// of their files are changed on disk
+func watchForReloads() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// Only poll for file changes if a check interval has been set
+	var tick <-chan time.Time
+	if Conf.Server.ReloadInterval > 0 {
+		t := time.NewTicker(time.Duration(Conf.Server.ReloadInterval) * time.Second)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	watched := watchedFiles()
+	for {
+		select {
+		case <-hup:
+			log.Print("SIGHUP received, reloading the configuration and release catalog")
+		case <-tick:
+			if maps.Equal(watched, watchedFiles()) {
+				continue
+			}
+			log.Print("Configuration or release catalog changed on disk, reloading them")
+		}
+
+		// Errors are logged by reloadConfig(), and the existing settings are kept
+		_ = reloadConfig()
+		watched = watchedFiles()
+	}
+}
+
+// watchedFiles returns the current state of the configuration, release catalog, and user agent rules files
+func watchedFiles() map[string]fileState {
+	paths := catalog.Load().paths
+	files := []string{configFile, catalogPath(paths), userAgentsPath(paths)}
+
+	state := make(map[string]fileState)
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			// Missing files are recorded with a zero state, so they're detected when they turn up again
+			state[f] = fileState{}
+			continue
+		}
+		state[f] = fileState{modTime: info.ModTime(), size: info.Size()}
+	}
+	return state
+}
+
+// reloadConfig re-reads the configuration file, release catalog, and user agent rules, then atomically swaps in the new
+// release catalog, rules, and the settings which can change without a restart (see liveSettings, along with the paths
+// and debug).  Requests already being served keep using the catalog they started with.  If anything goes wrong, the
+// existing settings are left in place.
+func reloadConfig() (err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	newConf, err := loadConfig(configFile)
+	if err != nil {
+		log.Printf("Reloading the configuration file '%s' failed, keeping the existing settings: %s", configFile, err)
+		return
+	}
+	fileName := catalogPath(newConf.Paths)
+	newCat, err := loadCatalog(fileName, newConf.Paths)
+	if err != nil {
+		log.Printf("Reloading the release catalog '%s' failed, keeping the existing one: %s", fileName, err)
+		return
+	}
+	uaFile := userAgentsPath(newConf.Paths)
+	newRules, err := loadUserAgentRules(uaFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		newRules, err = nil, nil
+	}
+	if err != nil {
+		log.Printf("Reloading the user agent rules '%s' failed, keeping the existing ones: %s", uaFile, err)
+		return
+	}
+
+	// The paths, debug, and the live settings can be changed on the fly.  They're swapped in rather than changed in
+	// Conf, as requests use them without taking reloadMu.  Everything else needs a restart to take effect
+	oldConf, cmpConf := withoutLiveSettings(Conf), withoutLiveSettings(newConf)
+	sections := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"acme", oldConf.ACME, cmpConf.ACME},
+		{"github", oldConf.GitHub, cmpConf.GitHub},
+		{"logging", oldConf.Logging, cmpConf.Logging},
+		{"metrics", oldConf.Metrics, cmpConf.Metrics},
+		{"pg", oldConf.Pg, cmpConf.Pg},
+		{"privacy", oldConf.Privacy, cmpConf.Privacy},
+		{"server", oldConf.Server, cmpConf.Server},
+		{"stats", oldConf.Stats, cmpConf.Stats},
+		{"tls", oldConf.TLS, cmpConf.TLS},
+	}
+	for _, z := range sections {
+		if !reflect.DeepEqual(z.old, z.new) {
+			log.Printf("Changes to the [%s] section of the configuration file need a restart to take effect, apart "+
+				"from %s", z.name, liveSettingNames)
+		}
+	}
+	newLive := newLiveSettings(newConf)
+	oldLive := liveConf.Load()
+	var applied []string
+	for _, z := range []struct {
+		name    string
+		changed bool
+	}{
+		{"debug", debug.Load() != newConf.Server.Debug},
+		{"forwarded_header", oldLive.forwardedHeader != newLive.forwardedHeader},
+		{"trusted_proxies", !slices.Equal(oldLive.trustedProxies, newLive.trustedProxies)},
+		{"api_token", oldLive.apiToken != newLive.apiToken},
+		{"export_token", oldLive.exportToken != newLive.exportToken},
+		{"pseudonym_key", oldLive.pseudonymKey != newLive.pseudonymKey},
+	} {
+		if z.changed {
+			applied = append(applied, z.name)
+		}
+	}
+	debug.Store(newConf.Server.Debug)
+	liveConf.Store(newLive)
+	if len(applied) > 0 {
+		log.Printf("Configuration settings changed: %v", applied)
+	}
+
+	// Swap in the new user agent rules
+	userAgentRules.Store(newRules)
+
+	// Swap in the new catalog, once the checksums of any new assets are ready
+	hashAssets(newCat)
+	oldCat := catalog.Swap(newCat)
+	added, removed, changed := catalogDiff(oldCat, newCat)
+	log.Printf("Release catalog '%s' reloaded, %d assets available for download.  Added: %s.  Removed: %s.  Changed: %s",
+		fileName, len(newCat.assets), listOrNone(added), listOrNone(removed), listOrNone(changed))
+	return
+}
+
+// The settings outside [paths] which take effect when reloading, for the log messages
+const liveSettingNames = "debug, forwarded_header, and trusted_proxies in [server], and api_token, export_token, and " +
+	"pseudonym_key in [stats]"
+
+// withoutLiveSettings returns a copy of the configuration with the paths and the settings which take effect when
+// reloading cleared, leaving only those which need a restart
+func withoutLiveSettings(conf TomlConfig) TomlConfig {
+	conf.Paths = PathInfo{}
+	conf.Server.Debug, conf.Server.ForwardedHeader = false, ""
+	conf.Server.TrustedProxies, conf.Server.trustedProxies = nil, nil
+	conf.Stats.APIToken, conf.Stats.ExportToken, conf.Stats.PseudonymKey = "", "", ""
+	return conf
+}
+
+// catalogDiff returns the names of the assets which were added, removed, or changed between two release catalogs
+func catalogDiff(oldCat, newCat *ReleaseCatalog) (added, removed, changed []string) {
+	var oldAssets map[string]CatalogAsset
+	if oldCat != nil {
+		oldAssets = oldCat.assets
+	}
+	for name, a := range newCat.assets {
+		o, ok := oldAssets[name]
+		if !ok {
+			added = append(added, name)
+		} else if o != a {
+			changed = append(changed, name)
+		}
+	}
+	for name := range oldAssets {
+		if _, ok := newCat.assets[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	slices.Sort(added)
+	slices.Sort(removed)
+	slices.Sort(changed)
+	return
+}
+
+// listOrNone formats a list of names for logging
+func listOrNone(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%v", names)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCatalog writes a minimal release catalog containing the given asset names
+func writeTestCatalog(t *testing.T, fileName string, names ...string) {
+	t.Helper()
+	s := "[[release]]\nversion = \"1.0.0\"\n"
+	for _, n := range names {
+		s += fmt.Sprintf("\n  [[release.asset]]\n  name = \"%s\"\n  timestamp = 2024-10-16T07:48:52Z\n", n)
+	}
+	require.NoError(t, os.WriteFile(fileName, []byte(s), 0644))
+}
+
+func TestReloadConfig(t *testing.T) {
+	// Save the global state, so it can be restored for the other tests
+	oldConf, oldConfigFile, oldCat, oldLive, oldDebug := Conf, configFile, catalog.Load(), liveConf.Load(), debug.Load()
+	t.Cleanup(func() {
+		Conf, configFile = oldConf, oldConfigFile
+		catalog.Store(oldCat)
+		liveConf.Store(oldLive)
+		debug.Store(oldDebug)
+	})
+
+	dir := t.TempDir()
+	catFile := filepath.Join(dir, "releases.toml")
+	configFile = filepath.Join(dir, "config.toml")
+	conf := fmt.Sprintf("[paths]\ncatalog = %q\ndataDir = %q\n", catFile, dir)
+	require.NoError(t, os.WriteFile(configFile, []byte(conf), 0644))
+	writeTestCatalog(t, catFile, "a.dmg", "b.msi")
+
+	var err error
+	Conf, err = loadConfig(configFile)
+	require.NoError(t, err)
+	liveConf.Store(newLiveSettings(Conf))
+	debug.Store(false)
+	require.NoError(t, readCatalog())
+	before := catalog.Load()
+
+	// Change the catalog, then reload
+	writeTestCatalog(t, catFile, "b.msi", "c.AppImage")
+	require.NoError(t, reloadConfig())
+	after := catalog.Load()
+
+	// The old catalog must be untouched, as in-flight requests may still be using it
+	_, ok := before.Asset("a.dmg")
+	assert.True(t, ok)
+	_, ok = after.Asset("a.dmg")
+	assert.False(t, ok)
+	_, ok = after.Asset("c.AppImage")
+	assert.True(t, ok)
+
+	added, removed, changed := catalogDiff(before, after)
+	assert.Equal(t, []string{"c.AppImage"}, added)
+	assert.Equal(t, []string{"a.dmg"}, removed)
+	assert.Empty(t, changed)
+
+	// A broken catalog must leave the existing one in place
+	require.NoError(t, os.WriteFile(catFile, []byte("[[release]]\nversion = \n"), 0644))
+	assert.Error(t, reloadConfig())
+	assert.Same(t, after, catalog.Load())
+
+	// Changed paths come with the new catalog, leaving Conf alone as requests may be reading it
+	newDir := t.TempDir()
+	writeTestCatalog(t, catFile, "b.msi")
+	conf = fmt.Sprintf("[paths]\ncatalog = %q\ndataDir = %q\n", catFile, newDir)
+	require.NoError(t, os.WriteFile(configFile, []byte(conf), 0644))
+	require.NoError(t, reloadConfig())
+	assert.Equal(t, newDir, catalog.Load().paths.DataDir)
+	assert.Equal(t, dir, after.paths.DataDir)
+	assert.Equal(t, dir, Conf.Paths.DataDir)
+
+	// The client address, token, and debug settings take effect straight away, again leaving Conf alone
+	conf += "\n[server]\ndebug = true\nforwarded_header = \"forwarded\"\ntrusted_proxies = [\"10.0.0.0/8\"]\n" +
+		"\n[stats]\napi_token = \"new secret\"\nexport_token = \"export\"\n"
+	require.NoError(t, os.WriteFile(configFile, []byte(conf), 0644))
+	require.NoError(t, reloadConfig())
+	live := liveConf.Load()
+	assert.Equal(t, "forwarded", live.forwardedHeader)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, live.trustedProxies)
+	assert.Equal(t, "new secret", live.apiToken)
+	assert.Equal(t, "export", live.exportToken)
+	assert.True(t, debug.Load())
+	assert.Empty(t, Conf.Stats.APIToken)
+
+	// Only the settings which need a restart are compared when deciding whether to say so
+	assert.Equal(t, withoutLiveSettings(Conf), withoutLiveSettings(newConfWith(t, conf)))
+}
+
+// newConfWith loads a configuration file with the given contents
+func newConfWith(t *testing.T, contents string) TomlConfig {
+	fileName := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(fileName, []byte(contents), 0644))
+	conf, err := loadConfig(fileName)
+	require.NoError(t, err)
+	return conf
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// shutdownServers stops the servers accepting new connections, then waits for the requests already in progress to
+// finish.  Downloads still going after the timeout are cut off, so a stuck or very slow client can't hold up the
+// shutdown forever
+func shutdownServers(timeout time.Duration, servers ...*http.Server) {
+	if n := activeTransfers.Load(); n > 0 {
+		log.Printf("Waiting up to %s for %d downloads in progress to finish", timeout, n)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		if s == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			err := s.Shutdown(ctx)
+			if errors.Is(err, context.DeadlineExceeded) {
+				log.Printf("Requests to '%s' were still in progress after %s, closing their connections", s.Addr,
+					timeout)
+				err = s.Close()
+			}
+			if err != nil {
+				log.Printf("Error when shutting down the server on '%s': %v", s.Addr, err)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+// closeDatabase writes any queued downloads, then closes the database connection gracefully
+func closeDatabase() {
+	stopDownloadLogger()
+	switch RecordDownloadsLocation {
+	case RECORD_IN_PG:
+		DB.Close()
+	case RECORD_IN_SQLITE:
+		err := sdb.Close()
+		if err != nil {
+			log.Printf("Error when closing the SQLite database: %v", err)
+		}
+	}
+}
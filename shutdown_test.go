@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownServers(t *testing.T) {
+	// Starts a server whose responses take the given time to finish, returning it along with its URL
+	start := func(delay time.Duration) (*http.Server, string) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "start ")
+			w.(http.Flusher).Flush()
+			time.Sleep(delay)
+			io.WriteString(w, "end")
+		})}
+		go s.Serve(l)
+		return s, "http://" + l.Addr().String()
+	}
+
+	// Requests the URL, returning the body received
+	fetch := func(url string, started chan<- struct{}) <-chan string {
+		result := make(chan string, 1)
+		go func() {
+			resp, err := http.Get(url)
+			close(started)
+			if err != nil {
+				result <- err.Error()
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			result <- string(body)
+		}()
+		return result
+	}
+
+	// Requests in progress are allowed to finish
+	s, url := start(200 * time.Millisecond)
+	started := make(chan struct{})
+	result := fetch(url, started)
+	<-started
+	shutdownServers(5*time.Second, s, nil)
+	assert.Equal(t, "start end", <-result)
+
+	// Unless they take longer than the timeout
+	s, url = start(5 * time.Second)
+	started = make(chan struct{})
+	result = fetch(url, started)
+	<-started
+	begin := time.Now()
+	shutdownServers(100*time.Millisecond, s)
+	assert.Less(t, time.Since(begin), 2*time.Second)
+	assert.Equal(t, "start ", <-result)
+
+	// New connections aren't accepted once shut down
+	_, err := http.Get(url)
+	assert.Error(t, err)
+}
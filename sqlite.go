@@ -1,11 +1,41 @@
 package main
 
 import (
+	"fmt"
 	"log"
 
 	sqlite "github.com/gwenn/gosqlite"
 )
 
+// The local SQLite database downloads are recorded in when PostgreSQL isn't available
+const sqliteDownloadsFile = "DB4S_downloads.sqlite"
+
+// Columns added to the download_log table since it was first created.  These are added to existing SQLite databases
+// when they're opened
+var sqliteAddedColumns = []struct {
+	name     string
+	dataType string
+}{
+	{"event_id", "text"},
+	{"forwarded_header", "text"},
+	{"asset_version", "text"},
+	{"asset_os", "text"},
+	{"asset_arch", "text"},
+	{"asset_package", "text"},
+	{"asset_portable", "boolean"},
+	{"ua_class", "text"},
+	{"ua_name", "text"},
+	{"ua_os", "text"},
+	{"range_start", "bigint"},
+	{"range_end", "bigint"},
+	{"file_size", "bigint"},
+	{"file_bytes_sent", "bigint"},
+	{"completed", "boolean"},
+	{"download_group", "text"},
+}
+
+// connectSQLite opens (creating if needed) the local SQLite database used for recording downloads when PostgreSQL
+// isn't available
 func connectSQLite(fileName string) (err error) {
 	sdb, err = sqlite.Open(fileName, sqlite.OpenReadWrite|sqlite.OpenCreate|sqlite.OpenFullMutex)
 	if err != nil {
@@ -34,12 +64,56 @@ func connectSQLite(fileName string) (err error) {
 			client_ipv4 text,
 			client_ipv6 text,
 			client_ip_strange text,
-			client_port integer
+			client_port integer,
+			event_id text,
+			forwarded_header text,
+			asset_version text,
+			asset_os text,
+			asset_arch text,
+			asset_package text,
+			asset_portable boolean,
+			ua_class text,
+			ua_name text,
+			ua_os text,
+			range_start bigint,
+			range_end bigint,
+			file_size bigint,
+			file_bytes_sent bigint,
+			completed boolean,
+			download_group text
 		)`
 	err = sdb.Exec(dbQuery)
 	if err != nil {
 		log.Printf("Something went wrong when creating the SQLite table for recording downloads: %v", err)
 		return
 	}
+
+	// Add any columns missing from download_log tables created by older versions of this program
+	cols, err := sdb.Columns("", "download_log")
+	if err != nil {
+		log.Printf("Couldn't retrieve the column list of the SQLite download_log table: %v", err)
+		return
+	}
+	existing := make(map[string]bool)
+	for _, c := range cols {
+		existing[c.Name] = true
+	}
+	for _, c := range sqliteAddedColumns {
+		if existing[c.name] {
+			continue
+		}
+		err = sdb.Exec(fmt.Sprintf(`ALTER TABLE download_log ADD COLUMN %s %s`, c.name, c.dataType))
+		if err != nil {
+			log.Printf("Couldn't add column '%s' to the SQLite download_log table: %v", c.name, err)
+			return
+		}
+	}
+
+	dbQuery = `CREATE UNIQUE INDEX IF NOT EXISTS download_log_event_id_uindex ON download_log (event_id)`
+	err = sdb.Exec(dbQuery)
+	if err != nil {
+		log.Printf("Something went wrong when creating the SQLite download_log event_id index: %v", err)
+		return
+	}
 	return
 }
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	sqlite "github.com/gwenn/gosqlite"
+)
+
+// statsQuery holds the options for a stats API request
+type statsQuery struct {
+	from, to time.Time // Start of the first period, and end of the last period
+	unit     string    // Period length.  "day", "week", or "month"
+	release  string    // Only include this DB4S version
+	platform string    // Only include downloads for this operating system
+}
+
+// statsPoint is the stats for a single period
+type statsPoint struct {
+	Date  string `json:"date"`
+	Count int64  `json:"count"`
+}
+
+// statsResponse is the JSON returned by the stats API
+type statsResponse struct {
+	From        string       `json:"from"`
+	To          string       `json:"to"`
+	Granularity string       `json:"granularity"`
+	Release     string       `json:"release,omitempty"`
+	Platform    string       `json:"platform,omitempty"`
+	Data        []statsPoint `json:"data"`
+}
+
+// Returned when there's no database to get the stats from
+var errNoStatsDatabase = errors.New("downloads aren't being recorded, so no stats are available")
+
+// tokenAuth only lets through requests with the stats API token from the config file.  It can be given as an
+// "Authorization: Bearer" header, or as the password for HTTP basic authentication (handy for web browsers).  The
+// challenge scheme is the one asked for when the token is missing or wrong.  If no token is configured, the stats
+// are turned off
+func tokenAuth(challenge string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := liveConf.Load().apiToken
+		if token == "" {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		if !hasToken(c, token) {
+			c.Header("WWW-Authenticate", challenge+` realm="stats"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "a valid API token is needed"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// hasToken returns true if the request includes the given (non empty) token, in the same ways as tokenAuth accepts
+func hasToken(c *gin.Context, token string) bool {
+	if token == "" {
+		return false
+	}
+	given, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok {
+		_, given, ok = c.Request.BasicAuth()
+	}
+	return ok && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// parseDateRange reads a "from" and "to" date (both included) in YYYY-MM-DD format, as used by the stats and export
+// options.  They default to the 30 days up to and including today
+func parseDateRange(fromDate, toDate string) (from, to time.Time, err error) {
+	to = time.Now().UTC()
+	if toDate != "" {
+		to, err = time.Parse(time.DateOnly, toDate)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid 'to' date '%s', it should be in YYYY-MM-DD format", toDate)
+		}
+	}
+	from = to.AddDate(0, 0, -29)
+	if fromDate != "" {
+		from, err = time.Parse(time.DateOnly, fromDate)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid 'from' date '%s', it should be in YYYY-MM-DD format", fromDate)
+		}
+	}
+	if to.Before(from) {
+		return from, to, errors.New("the 'to' date is before the 'from' date")
+	}
+	return
+}
+
+// parseStatsQuery reads the options for a stats API request from its query parameters.  The date range defaults to
+// the last 30 days, and the granularity to daily
+func parseStatsQuery(c *gin.Context) (q statsQuery, err error) {
+	from, to, err := parseDateRange(c.Query("from"), c.Query("to"))
+	if err != nil {
+		return
+	}
+	q.unit = c.DefaultQuery("granularity", "day")
+	switch q.unit {
+	case "day", "week", "month":
+	default:
+		return q, fmt.Errorf("unknown granularity '%s', it should be day, week, or month", q.unit)
+	}
+	q.from, q.to = periodStart(q.unit, from), periodEnd(q.unit, to)
+	q.release = c.Query("release")
+	q.platform = normaliseOS(c.Query("platform"))
+	return
+}
+
+// statsHandler returns a handler for a stats API endpoint, which looks up the stats using the given function.  Unless
+// platforms is set, the stats can't be broken down by platform, so requests asking for that are refused
+func statsHandler(lookup func(ctx context.Context, q statsQuery) ([]statsPoint, error), platforms bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, err := parseStatsQuery(c)
+		if err == nil && q.platform != "" && !platforms {
+			err = errors.New("these stats can't be filtered by platform")
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		data, err := lookup(c.Request.Context(), q)
+		if errors.Is(err, errNoStatsDatabase) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "retrieving the stats failed"})
+			log.Printf("Error when retrieving stats for '%s': %v", c.Request.URL, err)
+			return
+		}
+		if data == nil {
+			data = []statsPoint{}
+		}
+		c.JSON(http.StatusOK, statsResponse{
+			From:        q.from.Format(time.DateOnly),
+			To:          q.to.AddDate(0, 0, -1).Format(time.DateOnly),
+			Granularity: q.unit,
+			Release:     q.release,
+			Platform:    q.platform,
+			Data:        data,
+		})
+	}
+}
+
+// downloadStats returns the number of downloads in each period.  With PostgreSQL these come from the db4s_downloads_*
+// tables, while with SQLite they're calculated from download_log
+func downloadStats(ctx context.Context, q statsQuery) (data []statsPoint, err error) {
+	// Work out which files to include, if only some releases or platforms were asked for
+	var files []string
+	filtered := q.release != "" || q.platform != ""
+	if filtered {
+		files = catalog.Load().AssetNames(q.release, q.platform)
+		if len(files) == 0 {
+			return
+		}
+	}
+
+	switch RecordDownloadsLocation {
+	case RECORD_IN_PG:
+		dbQuery := `
+			SELECT s.stats_date, sum(s.num_downloads)
+			FROM ` + statsTable(q.unit, "downloads") + ` s
+				JOIN db4s_download_info d ON d.download_id = s.db4s_download
+			WHERE s.stats_date >= $1 AND s.stats_date < $2
+				AND ($3 = false OR d.file_name = ANY($4))
+			GROUP BY 1
+			ORDER BY 1`
+		return pgStats(ctx, dbQuery, q.from, q.to, filtered, files)
+	case RECORD_IN_SQLITE:
+		// download_log has every request, so it's limited to the files in the release catalog here.  Any query string
+		// is ignored, the same as when aggregating the PostgreSQL stats
+		if !filtered {
+			files = catalog.Load().AssetNames("", "")
+		}
+		args := []interface{}{sqliteTime(q.from), sqliteTime(q.to)}
+		for _, f := range files {
+			args = append(args, "/"+f)
+		}
+		dbQuery := `
+			SELECT ` + sqlitePeriod(q.unit) + `, count(*)
+			FROM download_log
+			WHERE datetime(request_time) >= ? AND datetime(request_time) < ?
+				AND request_type = 'GET'
+				AND coalesce(completed, status = 200)
+				AND coalesce(ua_class, '') <> 'bot'
+				AND substr(request, 1, instr(request || '?', '?') - 1)
+					IN (` + strings.TrimSuffix(strings.Repeat("?, ", len(files)), ", ") + `)
+			GROUP BY 1
+			ORDER BY 1`
+		return sqliteStats(dbQuery, args...)
+	}
+	return nil, errNoStatsDatabase
+}
+
+// userStats returns the number of different IP addresses checking for DB4S updates in each period.  With PostgreSQL
+// these come from the db4s_users_* tables, while with SQLite they're calculated from download_log.  When not limited
+// to one release, users who upgraded part way through a period are counted once for each release they used
+func userStats(ctx context.Context, q statsQuery) (data []statsPoint, err error) {
+	switch RecordDownloadsLocation {
+	case RECORD_IN_PG:
+		dbQuery := `
+			SELECT s.stats_date, sum(s.unique_ips)
+			FROM ` + statsTable(q.unit, "users") + ` s
+				JOIN db4s_release_info r ON r.release_id = s.db4s_release
+			WHERE s.stats_date >= $1 AND s.stats_date < $2
+				AND ($3 = '' OR r.version_number = $3)
+			GROUP BY 1
+			ORDER BY 1`
+		return pgStats(ctx, dbQuery, q.from, q.to, q.release)
+	case RECORD_IN_SQLITE:
+		// SQLite doesn't have regular expressions, so the version number is matched a bit more loosely.  Note the
+		// SQLite library passes empty strings as NULL
+		dbQuery := `
+			SELECT period, sum(n) FROM (
+				SELECT ` + sqlitePeriod(q.unit) + ` AS period, count(DISTINCT coalesce(client_ipv4, client_ipv6, client_ip_strange)) AS n
+				FROM download_log
+				WHERE datetime(request_time) >= ? AND datetime(request_time) < ?
+					AND (request = '/currentrelease' OR request LIKE '/currentrelease?%')
+					AND status = 200
+					AND coalesce(ua_class, '') <> 'bot'
+					AND http_user_agent LIKE 'sqlitebrowser %'
+					AND (coalesce(?, '') = '' OR http_user_agent = 'sqlitebrowser ' || ? OR http_user_agent LIKE 'sqlitebrowser ' || ? || ' %')
+				GROUP BY 1, http_user_agent
+			)
+			GROUP BY 1
+			ORDER BY 1`
+		return sqliteStats(dbQuery, sqliteTime(q.from), sqliteTime(q.to), q.release, q.release, q.release)
+	}
+	return nil, errNoStatsDatabase
+}
+
+// statsTable returns the name of the PostgreSQL stats table for a period length
+func statsTable(unit, kind string) string {
+	for _, p := range aggregatePeriods {
+		if p.unit == unit {
+			if kind == "users" {
+				return p.usersTable
+			}
+			return p.downloadsTable
+		}
+	}
+	panic("unknown stats period " + unit)
+}
+
+// pgStats runs a PostgreSQL stats query returning (date, count) rows
+func pgStats(ctx context.Context, dbQuery string, args ...interface{}) (data []statsPoint, err error) {
+	rows, err := DB.Query(ctx, dbQuery, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			date  time.Time
+			count int64
+		)
+		if err = rows.Scan(&date, &count); err != nil {
+			return
+		}
+		data = append(data, statsPoint{Date: date.Format(time.DateOnly), Count: count})
+	}
+	return data, rows.Err()
+}
+
+// sqliteStats runs a SQLite stats query returning (date, count) rows
+func sqliteStats(dbQuery string, args ...interface{}) (data []statsPoint, err error) {
+	stmt, err := sdb.Prepare(dbQuery)
+	if err != nil {
+		return
+	}
+	defer stmt.Finalize()
+	err = stmt.Select(func(s *sqlite.Stmt) (err error) {
+		var p statsPoint
+		p.Date, _ = s.ScanText(0)
+		p.Count, _, err = s.ScanInt64(1)
+		data = append(data, p)
+		return
+	}, args...)
+	return
+}
+
+// sqlitePeriod returns the SQLite expression giving the start date of the period a download is in.  Weeks start on
+// Monday, the same as PostgreSQL
+func sqlitePeriod(unit string) string {
+	switch unit {
+	case "week":
+		return `date(request_time, '-6 days', 'weekday 1')`
+	case "month":
+		return `strftime('%Y-%m-01', request_time)`
+	}
+	return `date(request_time)`
+}
+
+// sqliteTime formats a time the same way as SQLite's datetime() function
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(time.DateTime)
+}
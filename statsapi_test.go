@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// statsTestRouter records some downloads and update checks (and a bot download, which shouldn't be counted) in a SQLite
+// database, and returns a router using it, with "secret" as the stats API token
+func statsTestRouter(t *testing.T) *gin.Engine {
+	oldSdb, oldLocation, oldStats, oldCat, oldLive := sdb, RecordDownloadsLocation, Conf.Stats, catalog.Load(),
+		liveConf.Load()
+	t.Cleanup(func() {
+		sdb, RecordDownloadsLocation, Conf.Stats = oldSdb, oldLocation, oldStats
+		catalog.Store(oldCat)
+		liveConf.Store(oldLive)
+	})
+	require.NoError(t, readConfig())
+	require.NoError(t, readCatalog())
+
+	// Record some downloads and update checks in a SQLite database
+	require.NoError(t, connectSQLite(filepath.Join(t.TempDir(), "downloads.sqlite")))
+	t.Cleanup(func() { sdb.Close() })
+	RecordDownloadsLocation = RECORD_IN_SQLITE
+	rec := func(when, ip, request, ua string, status int) downloadRecord {
+		tm, err := time.Parse(time.RFC3339, when)
+		require.NoError(t, err)
+		return downloadRecord{
+			ClientIPv4:    pgtype.Text{String: ip, Valid: true},
+			RequestTime:   tm,
+			RequestType:   "GET",
+			Request:       request,
+			Protocol:      "HTTP/1.1",
+			Status:        status,
+			HTTPUserAgent: ua,
+			EventID:       newEventID(),
+		}
+	}
+	recs := []downloadRecord{
+		rec("2024-10-14T10:00:00Z", "192.0.2.1", "/DB.Browser.for.SQLite-v3.13.1-win64.msi", "test", 200),
+		rec("2024-10-14T11:00:00Z", "192.0.2.2", "/DB.Browser.for.SQLite-v3.13.1-win64.msi", "test", 200),
+		rec("2024-10-14T12:00:00Z", "192.0.2.3", "/DB.Browser.for.SQLite-v3.13.1-win64.msi", "test", 404),
+		rec("2024-10-15T23:30:00-05:00", "192.0.2.4", "/DB.Browser.for.SQLite-v3.13.1.dmg", "test", 200),
+		rec("2024-10-21T10:00:00Z", "192.0.2.5", "/DB.Browser.for.SQLite-v3.13.0-win64.msi", "test", 200),
+		rec("2024-10-14T10:00:00Z", "192.0.2.1", "/currentrelease", "sqlitebrowser 3.13.1", 200),
+		rec("2024-10-14T11:00:00Z", "192.0.2.1", "/currentrelease", "sqlitebrowser 3.13.1", 200),
+		rec("2024-10-14T12:00:00Z", "192.0.2.2", "/currentrelease?os=windows", "sqlitebrowser 3.13.0", 200),
+		rec("2024-10-14T13:00:00Z", "192.0.2.3", "/currentrelease", "curl/8.0", 200),
+		rec("2024-10-14T13:00:00Z", "192.0.2.9", "/DB.Browser.for.SQLite-v3.13.1.dmg",
+			"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", 200),
+	}
+
+	// A download made in two pieces, counted once when it's complete, and one which was cut short
+	partial := func(r downloadRecord, start, end int64, completed bool) downloadRecord {
+		r.FileSize = pgtype.Int8{Int64: 1000, Valid: true}
+		r.FileBytesSent = pgtype.Int8{Int64: end - start, Valid: true}
+		if r.Status == 206 {
+			r.RangeStart = pgtype.Int8{Int64: start, Valid: true}
+			r.RangeEnd = pgtype.Int8{Int64: end - 1, Valid: true}
+		}
+		r.Completed = pgtype.Bool{Bool: completed, Valid: true}
+		return r
+	}
+	recs = append(recs,
+		partial(rec("2024-10-21T11:00:00Z", "192.0.2.6", "/DB.Browser.for.SQLite-v3.13.0-win64.msi", "test", 206), 0,
+			600, false),
+		partial(rec("2024-10-21T11:30:00Z", "192.0.2.6", "/DB.Browser.for.SQLite-v3.13.0-win64.msi", "test", 206), 600,
+			1000, true),
+		partial(rec("2024-10-21T12:00:00Z", "192.0.2.7", "/DB.Browser.for.SQLite-v3.13.0-win64.msi", "test", 200), 0,
+			100, false),
+	)
+	rules, err := loadUserAgentRules("useragents.toml")
+	require.NoError(t, err)
+	for i := range recs {
+		recs[i].setUserAgentClass(rules)
+	}
+	writeDownloads(recs)
+
+	Conf.Stats.APIToken = "secret"
+	liveConf.Store(newLiveSettings(Conf))
+	router, err := setupRouter(true)
+	require.NoError(t, err)
+	return router
+}
+
+func TestStatsAPI(t *testing.T) {
+	router := statsTestRouter(t)
+	get := func(url, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+	stats := func(url string) (resp statsResponse) {
+		w := get(url, "secret")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return
+	}
+
+	// A valid token is needed
+	assert.Equal(t, 401, get("/api/stats/downloads", "").Code)
+	assert.Equal(t, 401, get("/api/stats/downloads", "wrong").Code)
+
+	// Downloads
+	resp := stats("/api/stats/downloads?from=2024-10-14&to=2024-10-21")
+	assert.Equal(t, statsResponse{From: "2024-10-14", To: "2024-10-21", Granularity: "day", Data: []statsPoint{
+		{"2024-10-14", 2}, {"2024-10-16", 1}, {"2024-10-21", 2},
+	}}, resp)
+	resp = stats("/api/stats/downloads?from=2024-10-16&to=2024-10-16&granularity=week")
+	assert.Equal(t, "2024-10-14", resp.From)
+	assert.Equal(t, "2024-10-20", resp.To)
+	assert.Equal(t, []statsPoint{{"2024-10-14", 3}}, resp.Data)
+	resp = stats("/api/stats/downloads?from=2024-10-01&to=2024-10-31&granularity=month&release=3.13.1")
+	assert.Equal(t, []statsPoint{{"2024-10-01", 3}}, resp.Data)
+	resp = stats("/api/stats/downloads?from=2024-10-01&to=2024-10-31&granularity=month&platform=win")
+	assert.Equal(t, "windows", resp.Platform)
+	assert.Equal(t, []statsPoint{{"2024-10-01", 4}}, resp.Data)
+	resp = stats("/api/stats/downloads?from=2024-10-01&to=2024-10-31&release=9.9.9")
+	assert.Equal(t, []statsPoint{}, resp.Data)
+
+	// Query strings on the download links don't stop them being counted, the same as with PostgreSQL
+	writeDownloads([]downloadRecord{{
+		ClientIPv4:    pgtype.Text{String: "192.0.2.8", Valid: true},
+		RequestTime:   time.Date(2024, 10, 22, 10, 0, 0, 0, time.UTC),
+		RequestType:   "GET",
+		Request:       "/DB.Browser.for.SQLite-v3.13.1.dmg?utm_source=sqlitebrowser.org",
+		Protocol:      "HTTP/1.1",
+		Status:        200,
+		HTTPUserAgent: "test",
+		EventID:       newEventID(),
+	}})
+	resp = stats("/api/stats/downloads?from=2024-10-22&to=2024-10-22&release=3.13.1")
+	assert.Equal(t, []statsPoint{{"2024-10-22", 1}}, resp.Data)
+
+	// Users
+	resp = stats("/api/stats/users?from=2024-10-14&to=2024-10-14")
+	assert.Equal(t, []statsPoint{{"2024-10-14", 2}}, resp.Data)
+	resp = stats("/api/stats/users?from=2024-10-14&to=2024-10-14&release=3.13.1")
+	assert.Equal(t, []statsPoint{{"2024-10-14", 1}}, resp.Data)
+
+	// Bad requests
+	assert.Equal(t, 400, get("/api/stats/downloads?granularity=year", "secret").Code)
+	assert.Equal(t, 400, get("/api/stats/downloads?from=14/10/2024", "secret").Code)
+	assert.Equal(t, 400, get("/api/stats/downloads?from=2024-10-15&to=2024-10-14", "secret").Code)
+
+	// The users stats can't be broken down by platform, so that isn't silently ignored
+	w := get("/api/stats/users?from=2024-10-14&to=2024-10-14&platform=windows", "secret")
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "platform")
+
+	// API requests aren't recorded as downloads
+	stopDownloadLogger()
+	var n int
+	require.NoError(t, sdb.OneValue(`SELECT count(*) FROM download_log WHERE request LIKE '/api/%'`, &n))
+	assert.Equal(t, 0, n)
+
+	// The API is turned off without a token
+	Conf.Stats.APIToken = ""
+	liveConf.Store(newLiveSettings(Conf))
+	assert.Equal(t, 404, get("/api/stats/downloads", "").Code)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Key used to pass the response controller for the connection from writeDeadlineMiddleware to the handlers
+const responseControllerKey = "db4s_response_controller"
+
+// setServerDefaults fills in the server settings not given in the config file
+func setServerDefaults(s *ServerInfo) {
+	if s.ShutdownTimeout <= 0 {
+		s.ShutdownTimeout = 60
+	}
+	if s.WriteTimeout <= 0 {
+		s.WriteTimeout = 30
+	}
+	if s.TransferIdleTimeout <= 0 {
+		s.TransferIdleTimeout = 60
+	}
+	switch s.HTTP {
+	case "":
+		s.HTTP = "redirect"
+	case "redirect", "serve":
+	default:
+		log.Printf("Unknown http setting '%s' for the server, using 'redirect' instead", s.HTTP)
+		s.HTTP = "redirect"
+	}
+	if s.RedirectPort <= 0 {
+		s.RedirectPort = s.SSLPort
+	}
+	switch s.ForwardedHeader = strings.ToLower(s.ForwardedHeader); s.ForwardedHeader {
+	case "":
+		s.ForwardedHeader = "x-forwarded-for"
+	case "x-forwarded-for", "forwarded":
+	default:
+		log.Printf("Unknown forwarded_header setting '%s' for the server, using 'x-forwarded-for' instead",
+			s.ForwardedHeader)
+		s.ForwardedHeader = "x-forwarded-for"
+	}
+}
+
+// writeDeadlineMiddleware gives each response write_timeout seconds to be sent.  The server itself has no write
+// timeout, as that would cut off downloads of the larger files over slow connections, so this is set per request
+// instead.  Handlers sending files or other large responses use transferWriter to keep extending the deadline while
+// data is still moving.  This needs to come before the gzip middleware, as that hides the connection's response writer
+func writeDeadlineMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rc := http.NewResponseController(c.Writer)
+		c.Set(responseControllerKey, rc)
+
+		// Not all response writers support deadlines (eg the ones used in testing), which is fine
+		_ = rc.SetWriteDeadline(time.Now().Add(time.Duration(Conf.Server.WriteTimeout) * time.Second))
+		c.Next()
+	}
+}
+
+// progressWriter extends the write deadline of the connection as data is written, so a transfer is only aborted when
+// nothing has been sent for the transfer idle timeout, no matter how long the whole transfer takes
+type progressWriter struct {
+	http.ResponseWriter
+	rc       *http.ResponseController
+	idle     time.Duration
+	extended time.Time
+}
+
+// transferWriter returns a response writer for sending a large response, which keeps the write deadline of the
+// connection moving along while data is flowing
+func transferWriter(c *gin.Context) http.ResponseWriter {
+	v, ok := c.Get(responseControllerKey)
+	if !ok {
+		return c.Writer
+	}
+	w := &progressWriter{
+		ResponseWriter: c.Writer,
+		rc:             v.(*http.ResponseController),
+		idle:           time.Duration(Conf.Server.TransferIdleTimeout) * time.Second,
+	}
+	w.extend(time.Now())
+	return w
+}
+
+// extend moves the write deadline to the idle timeout from now
+func (w *progressWriter) extend(now time.Time) {
+	_ = w.rc.SetWriteDeadline(now.Add(w.idle))
+	w.extended = now
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	// Setting the deadline for every write isn't needed, as they're only a few KB each
+	if now := time.Now(); now.Sub(w.extended) >= time.Second {
+		w.extend(now)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying response writer, for http.ResponseController
+func (w *progressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteDeadlines(t *testing.T) {
+	oldServer := Conf.Server
+	t.Cleanup(func() { Conf.Server = oldServer })
+	Conf.Server.WriteTimeout, Conf.Server.TransferIdleTimeout = 1, 1
+
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(writeDeadlineMiddleware())
+
+	// Sends the response in pieces, taking longer in total than the write timeout
+	send := func(w http.ResponseWriter) {
+		for i := 0; i < 4; i++ {
+			io.WriteString(w, "piece ")
+			http.NewResponseController(w).Flush()
+			time.Sleep(400 * time.Millisecond)
+		}
+		io.WriteString(w, "done")
+	}
+	router.GET("/slow", func(c *gin.Context) {
+		send(c.Writer)
+	})
+	router.GET("/transfer", func(c *gin.Context) {
+		send(transferWriter(c))
+	})
+	s := httptest.NewServer(router)
+	defer s.Close()
+	get := func(url string) (string, error) {
+		resp, err := http.Get(s.URL + url)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	// Ordinary responses are cut off once the write timeout is up
+	body, err := get("/slow")
+	assert.Error(t, err)
+	assert.NotContains(t, body, "done")
+
+	// Transfers keep going, as long as data is still moving
+	body, err = get("/transfer")
+	require.NoError(t, err)
+	assert.Equal(t, "piece piece piece piece done", body)
+}
@@ -1,17 +1,57 @@
 package main
 
-import "github.com/jackc/pgx/v5/pgtype"
+import (
+	"net/netip"
+	"regexp"
+	"time"
 
-// TomlConfig is the structure for holding the application configuration
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// TomlConfig is the structure for holding the application configuration.  Reloading the configuration file only
+// changes the paths and the settings in liveSettings (plus debug), the rest need a restart
 type TomlConfig struct {
-	Paths  PathInfo
-	Pg     PGInfo
-	Server ServerInfo
-	TLS    TLSInfo
+	ACME    ACMEInfo `toml:"acme"`
+	GitHub  GitHubInfo
+	Logging LoggingInfo
+	Metrics MetricsInfo
+	Paths   PathInfo
+	Pg      PGInfo
+	Privacy PrivacyInfo
+	Server  ServerInfo
+	Stats   StatsInfo
+	TLS     TLSInfo
+}
+type ACMEInfo struct {
+	CACert       string   `toml:"ca_cert"`       // CA certificate the ACME server's own certificate is checked with, eg for a test server
+	CacheDir     string   `toml:"cache_dir"`     // Directory the certificates and account key are kept in.  Defaults to "acme" in the base directory
+	DirectoryURL string   `toml:"directory_url"` // ACME directory URL.  Defaults to Let's Encrypt
+	Domains      []string // Domains to get certificates for.  ACME is turned off if none are given
+	Email        string   // Contact address given to the ACME server, for expiry notices and the like
+}
+type GitHubInfo struct {
+	APIURL     string `toml:"api_url"` // Base URL of the GitHub API.  Defaults to https://api.github.com
+	Repository string // Repository whose release download counts are collected.  Defaults to sqlitebrowser/sqlitebrowser
+	Token      string // Optional GitHub access token, for a higher API rate limit
+}
+type LoggingInfo struct {
+	BatchSize      int    `toml:"batch_size"`     // Maximum number of download records written to the database at once
+	FlushInterval  int    `toml:"flush_interval"` // Maximum number of seconds queued download records wait to be written
+	Journal        string // File download records are saved to when PostgreSQL isn't available
+	QueueFull      string `toml:"queue_full"`      // What to do when the queue is full.  "drop" the record, or "block" until there's space
+	QueueSize      int    `toml:"queue_size"`      // Maximum number of download records waiting to be written
+	RangeWindow    int    `toml:"range_window"`    // Seconds a partial download can go without new range requests before it's forgotten
+	ReplayInterval int    `toml:"replay_interval"` // Seconds between attempts to replay the journal into PostgreSQL
+}
+type MetricsInfo struct {
+	Listen string // Address to serve the metrics on, eg "127.0.0.1:9090".  If not set, they're at /metrics on the main server
 }
 type PathInfo struct {
-	BaseDir string // Location of the git source
-	DataDir string // Directory where the downloads are located
+	BaseDir       string // Location of the git source
+	Catalog       string // Location of the release catalog file.  Defaults to releases.toml in BaseDir
+	ChecksumCache string `toml:"checksum_cache"` // Optional file used to cache the asset checksums between restarts
+	DataDir       string // Directory where the downloads are located
+	UserAgents    string `toml:"user_agents"` // Location of the user agent rules file.  Defaults to useragents.toml in BaseDir
 }
 type PGInfo struct {
 	Database       string
@@ -22,10 +62,35 @@ type PGInfo struct {
 	SSL            bool
 	Username       string
 }
+type PrivacyInfo struct {
+	Anonymise       string // How client addresses are anonymised before being recorded.  "none", "truncate", or "hmac"
+	HMACKey         string `toml:"hmac_key"`         // Secret key the rotating salts for "hmac" anonymisation are derived from
+	RetentionAction string `toml:"retention_action"` // What to do with old download_log rows.  "delete" or "anonymise"
+	RetentionDays   int    `toml:"retention_days"`   // Days download_log rows are kept as recorded.  0 keeps them forever
+	SaltRotation    int    `toml:"salt_rotation"`    // Hours each "hmac" anonymisation salt is used for.  Defaults to 24
+}
 type ServerInfo struct {
-	Debug   bool
-	Port    int
-	SSLPort int
+	Debug               bool
+	ForwardedHeader     string   `toml:"forwarded_header"` // Forwarding header our trusted proxies write the client address to ("x-forwarded-for" or "forwarded")
+	HTTP                string   `toml:"http"`             // With TLS, whether plain HTTP requests are redirected to HTTPS ("redirect") or served ("serve")
+	HTTPPaths           []string `toml:"http_paths"`       // Paths served over plain HTTP even when redirecting the rest
+	Port                int
+	RedirectPort        int `toml:"redirect_port"`    // HTTPS port used in redirects, if it's not the SSL port.  eg when behind port forwarding
+	ReloadInterval      int `toml:"reload_interval"`  // Seconds between checks for config or release catalog changes.  0 disables
+	ShutdownTimeout     int `toml:"shutdown_timeout"` // Seconds to wait for downloads in progress to finish when shutting down
+	SSLPort             int
+	TransferIdleTimeout int      `toml:"transfer_idle_timeout"` // Seconds a file transfer can go without sending anything before it's aborted
+	TrustedProxies      []string `toml:"trusted_proxies"`       // Proxies (IP addresses or CIDR ranges) whose forwarding headers are believed
+	WriteTimeout        int      `toml:"write_timeout"`         // Seconds a response (other than a file transfer) has to be sent
+
+	// The trusted proxies, parsed
+	trustedProxies []netip.Prefix
+}
+type StatsInfo struct {
+	AggregateInterval int    `toml:"aggregate_interval"` // Seconds between updates of the download stats tables.  0 disables
+	APIToken          string `toml:"api_token"`          // Token needed to use the stats API.  The API is turned off if not set
+	ExportToken       string `toml:"export_token"`       // Token needed for HTTP exports with the real client addresses.  They're only pseudonymised if not set
+	PseudonymKey      string `toml:"pseudonym_key"`      // Key for pseudonymising IP addresses in exports.  Random for each export if not set
 }
 
 type TLSInfo struct {
@@ -33,6 +98,84 @@ type TLSInfo struct {
 	KeyFile  string // Full path of the TLS private key file
 }
 
+// liveSettings holds the configuration settings which take effect when the configuration file is reloaded, rather than
+// needing a restart
+type liveSettings struct {
+	forwardedHeader string
+	trustedProxies  []netip.Prefix
+	apiToken        string
+	exportToken     string
+	pseudonymKey    string
+}
+
+// newLiveSettings returns the reloadable settings from a configuration
+func newLiveSettings(conf TomlConfig) *liveSettings {
+	return &liveSettings{
+		forwardedHeader: conf.Server.ForwardedHeader,
+		trustedProxies:  conf.Server.trustedProxies,
+		apiToken:        conf.Stats.APIToken,
+		exportToken:     conf.Stats.ExportToken,
+		pseudonymKey:    conf.Stats.PseudonymKey,
+	}
+}
+
+// ReleaseCatalog holds the list of releases, and the files in them, that we serve
+type ReleaseCatalog struct {
+	Files    []CatalogAsset   `toml:"file"`    // Downloadable files which aren't part of a specific release
+	Releases []CatalogRelease `toml:"release"` // DB4S releases, newest first
+
+	// Lookup index of all the assets, keyed by file name
+	assets map[string]CatalogAsset
+
+	// The paths from the configuration the catalog was loaded with, including the directory the assets are served
+	// from.  They're kept here rather than only in Conf, so they're swapped along with the catalog when reloading
+	paths PathInfo
+}
+type CatalogRelease struct {
+	Assets  []CatalogAsset `toml:"asset"`
+	Channel string         // Release channel, eg "stable", "beta", "nightly".  Defaults to "stable"
+	Notes   string         // URL of the release announcement.  Defaults to the GitHub release page
+	Version string
+}
+type CatalogAsset struct {
+	Arch        string    // CPU architecture the asset is for.  eg "x86", "x64", "arm64", "universal"
+	Description string    // Text shown next to the download link on the index page.  May contain html
+	Hidden      bool      // Hidden assets are still served, but aren't listed on the index page
+	Name        string    // File name of the asset in the data directory
+	OS          string    // Operating system the asset is for.  eg "windows", "macos", "linux"
+	SHA256      string    // Expected SHA256 checksum of the asset
+	Timestamp   time.Time // Last modified timestamp sent to clients when downloading the asset
+}
+
+// UserAgentRules holds the rules used to classify the user agents of download requests
+type UserAgentRules struct {
+	Clients []UserAgentRule `toml:"client"` // Checked in order, the first match giving the kind of client
+	OS      []UserAgentRule `toml:"os"`     // Checked in order, the first match giving the operating system family
+}
+type UserAgentRule struct {
+	Class   string // Kind of client, for client rules.  eg "browser", "bot", "package_manager"
+	Name    string // Name of the client or operating system family.  eg "Firefox", "winget", "windows"
+	Pattern string // Regular expression matched against the user agent
+
+	// The pattern, compiled
+	regex *regexp.Regexp
+}
+
+// currentReleaseInfo is the JSON version of the /currentrelease response
+type currentReleaseInfo struct {
+	Version string               `json:"version"`
+	Channel string               `json:"channel"`
+	Notes   string               `json:"notes"`
+	Asset   *currentReleaseAsset `json:"asset,omitempty"`
+}
+type currentReleaseAsset struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	OS     string `json:"os"`
+	Arch   string `json:"arch"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
 // dbEntry is used for storing the new database entries
 type dbEntry struct {
 	ipv4      pgtype.Text
@@ -41,6 +184,22 @@ type dbEntry struct {
 	port      pgtype.Int4
 }
 
+// AddressClass describes the kind of client address given to parseClientAddress()
+type AddressClass string
+
+const (
+	ADDRESS_IPV4        AddressClass = "ipv4"
+	ADDRESS_IPV4_PORT   AddressClass = "ipv4 with port"
+	ADDRESS_IPV4_MAPPED AddressClass = "ipv4-mapped ipv6"
+	ADDRESS_IPV6        AddressClass = "ipv6"
+	ADDRESS_IPV6_PORT   AddressClass = "ipv6 with port"
+	ADDRESS_IPV6_ZONE   AddressClass = "ipv6 with zone"
+	ADDRESS_BAD_PORT    AddressClass = "invalid port"
+	ADDRESS_EMPTY       AddressClass = "empty"
+	ADDRESS_MULTIPLE    AddressClass = "multiple addresses"
+	ADDRESS_INVALID     AddressClass = "not an ip address"
+)
+
 // RecordDownloads are used to determine where downloads are recorded
 type RecordDownloads int
 
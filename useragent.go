@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"regexp"
+	"slices"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// The kinds of client a user agent can be classified as
+var userAgentClasses = []string{"browser", "download_manager", "package_manager", "bot", "updater", "cli"}
+
+// userAgentsPath returns the location of the user agent rules file
+func userAgentsPath(paths PathInfo) string {
+	if paths.UserAgents != "" {
+		return paths.UserAgents
+	}
+	return filepath.Join(paths.BaseDir, "useragents.toml")
+}
+
+// loadUserAgentRules reads a user agent rules file, compiling the patterns in it
+func loadUserAgentRules(fileName string) (rules *UserAgentRules, err error) {
+	rules = &UserAgentRules{}
+	if _, err = toml.DecodeFile(fileName, rules); err != nil {
+		return nil, err
+	}
+	compile := func(kind string, list []UserAgentRule) error {
+		for i, r := range list {
+			if r.Name == "" {
+				return fmt.Errorf("user agent rules '%s' have a %s rule without a name", fileName, kind)
+			}
+			re, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				return fmt.Errorf("user agent rules '%s' have a bad pattern for '%s': %w", fileName, r.Name, err)
+			}
+			list[i].regex = re
+		}
+		return nil
+	}
+	if err = compile("client", rules.Clients); err != nil {
+		return nil, err
+	}
+	if err = compile("os", rules.OS); err != nil {
+		return nil, err
+	}
+	for _, r := range rules.Clients {
+		if !slices.Contains(userAgentClasses, r.Class) {
+			return nil, fmt.Errorf("user agent rules '%s' have an unknown class '%s' for '%s'", fileName, r.Class,
+				r.Name)
+		}
+	}
+	return
+}
+
+// readUserAgentRules loads the user agent rules file specified in the configuration.  If there isn't one, downloads
+// are recorded without being classified
+func readUserAgentRules() (err error) {
+	fileName := userAgentsPath(Conf.Paths)
+	rules, err := loadUserAgentRules(fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("No user agent rules found at '%s', so downloads won't be classified", fileName)
+		userAgentRules.Store(nil)
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	userAgentRules.Store(rules)
+	if debug.Load() {
+		log.Printf("User agent rules '%s' loaded, %d client and %d operating system rules", fileName,
+			len(rules.Clients), len(rules.OS))
+	}
+	return
+}
+
+// classify returns the kind of client, client name, and operating system family for a user agent.  The class is
+// "unknown" if no client rule matches, and the operating system is empty if no operating system rule does
+func (rules *UserAgentRules) classify(ua string) (class, name, osFamily string) {
+	class = "unknown"
+	for _, r := range rules.Clients {
+		if r.regex.MatchString(ua) {
+			class, name = r.Class, r.Name
+			break
+		}
+	}
+	for _, r := range rules.OS {
+		if r.regex.MatchString(ua) {
+			osFamily = r.Name
+			break
+		}
+	}
+	return
+}
+
+// setUserAgentClass fills in the user agent classification of a download record.  With no rules, it's left empty
+func (r *downloadRecord) setUserAgentClass(rules *UserAgentRules) {
+	if rules == nil {
+		return
+	}
+	class, name, osFamily := rules.classify(r.HTTPUserAgent)
+	text := func(s string) pgtype.Text {
+		return pgtype.Text{String: s, Valid: s != ""}
+	}
+	r.UAClass, r.UAName, r.UAOS = text(class), text(name), text(osFamily)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyUserAgent(t *testing.T) {
+	rules, err := loadUserAgentRules("useragents.toml")
+	require.NoError(t, err)
+	tests := []struct {
+		ua, class, name, os string
+	}{
+		{"sqlitebrowser 3.13.1", "updater", "DB4S", ""},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/130.0.0.0 Safari/537.36", "browser", "Chrome", "windows"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/130.0.0.0 Safari/537.36 Edg/130.0.0.0", "browser", "Edge", "windows"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/18.0 Safari/605.1.15", "browser", "Safari", "macos"},
+		{"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:131.0) Gecko/20100101 Firefox/131.0", "browser", "Firefox", "linux"},
+		{"Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/130.0.0.0 Mobile Safari/537.36", "browser", "Chrome", "android"},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "bot", "Search engine", ""},
+		{"Mozilla/5.0 AppleWebKit/537.36 (KHTML, like Gecko; compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm) Chrome/116.0.1938.76 Safari/537.36", "bot", "Search engine", ""},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/120.0.0.0 Safari/537.36", "bot", "Headless browser", "linux"},
+		{"winget-cli WindowsPackageManager/1.9.2411 DesktopAppInstaller/Microsoft.DesktopAppInstaller v1.24.25180.0", "package_manager", "winget", "windows"},
+		{"Microsoft-Delivery-Optimization/10.0", "package_manager", "winget", "windows"},
+		{"Chocolatey Command Line", "package_manager", "Chocolatey", "windows"},
+		{"Homebrew/4.4.2 (Macintosh; arm64 Mac OS X 15.0.1) curl/8.7.1", "package_manager", "Homebrew", "macos"},
+		{"aria2/1.37.0", "download_manager", "aria2", ""},
+		{"curl/8.0", "cli", "curl", ""},
+		{"Wget/1.21.4", "cli", "Wget", ""},
+		{"Mozilla/5.0 (Windows NT; Windows NT 10.0; en-GB) WindowsPowerShell/5.1.22621.4249", "cli", "PowerShell", "windows"},
+		{"python-requests/2.32.3", "cli", "Script", ""},
+		{"test", "unknown", "", ""},
+		{"", "unknown", "", ""},
+	}
+	for _, tt := range tests {
+		class, name, osFamily := rules.classify(tt.ua)
+		assert.Equal(t, tt.class, class, tt.ua)
+		assert.Equal(t, tt.name, name, tt.ua)
+		assert.Equal(t, tt.os, osFamily, tt.ua)
+	}
+
+	// Without any rules, nothing is filled in
+	rec := downloadRecord{HTTPUserAgent: "curl/8.0"}
+	rec.setUserAgentClass(nil)
+	assert.False(t, rec.UAClass.Valid)
+	rec.setUserAgentClass(rules)
+	assert.Equal(t, "cli", rec.UAClass.String)
+	assert.Equal(t, "curl", rec.UAName.String)
+	assert.False(t, rec.UAOS.Valid)
+}
+
+func TestLoadUserAgentRules(t *testing.T) {
+	dir := t.TempDir()
+	load := func(s string) error {
+		fileName := filepath.Join(dir, "useragents.toml")
+		require.NoError(t, os.WriteFile(fileName, []byte(s), 0644))
+		_, err := loadUserAgentRules(fileName)
+		return err
+	}
+	assert.NoError(t, load("[[client]]\nclass = \"bot\"\nname = \"x\"\npattern = \"x\"\n"))
+	assert.ErrorContains(t, load("[[client]]\nclass = \"robot\"\nname = \"x\"\npattern = \"x\"\n"), "unknown class")
+	assert.ErrorContains(t, load("[[client]]\nclass = \"bot\"\nname = \"x\"\npattern = \"(\"\n"), "bad pattern")
+	assert.ErrorContains(t, load("[[os]]\npattern = \"x\"\n"), "without a name")
+}